@@ -63,16 +63,59 @@ func IfaceToBool(v interface{}) (bool, bool) {
   s, ok := v.(string)
   if ok {
     switch strings.ToLower(s) {
-    case "1":
-    case "true":
-    case "yes":
+    case "1", "true", "yes":
       return true, true
-    case "0":
-    case "false":
-    case "no":
+    case "0", "false", "no":
       return false, true
     }
   }
 
   return false, false
 }
+
+// The JSON feed collapses single item arrays into a lone object, while
+// the XML feed always produces a list. Either shape is returned as a slice.
+func IfaceToSlice(v interface{}) ([]interface{}, bool) {
+  switch t := v.(type) {
+  case []interface{}:
+    return t, true
+  case map[string]interface{}:
+    return []interface{}{t}, true
+  }
+
+  return nil, false
+}
+
+// Returns v as an object. If v is a list, as the XML feed produces for
+// every child element, the first item is used.
+func IfaceToMap(v interface{}) (map[string]interface{}, bool) {
+  switch t := v.(type) {
+  case map[string]interface{}:
+    return t, true
+  case []interface{}:
+    if len(t) == 0 {
+      return nil, false
+    }
+    m, ok := t[0].(map[string]interface{})
+    return m, ok
+  }
+
+  return nil, false
+}
+
+// Element text is a plain string in the JSON feed, but an object holding
+// "content" when the element has attributes, or in the XML feed, where
+// it is also wrapped in a list. Any of these shapes is returned as text.
+func IfaceToText(v interface{}) (string, bool) {
+  s, ok := IfaceToString(v)
+  if ok {
+    return s, true
+  }
+
+  m, ok := IfaceToMap(v)
+  if !ok {
+    return "", false
+  }
+
+  return IfaceToString(m["content"])
+}
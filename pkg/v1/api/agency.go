@@ -1,9 +1,11 @@
 package api
 
 import (
-	"encoding/json"
-  "slices"
+	"context"
 	"errors"
+	"log/slog"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/lcyvin/go-umoparse/internal/utils"
@@ -14,24 +16,36 @@ type Agency struct {
   Tag         string
   ShortTitle  string
   RegionTitle string
+  // The agency's time zone, which schedules and message intervals are
+  // given in, see AgencyTimezones. It is nil if the zone isn't known,
+  // and times are then given in the local time zone.
+  Location    *time.Location
   Routes      []*Route
   api         *ApiHandler
   cacheAge    time.Time
+  // guards Routes and cacheAge
+  mu          sync.Mutex
 }
 
 func GetAgency(agencyTag string, opts...ApiHandlerOption) (*Agency, error) {
   return DefaultApiHandler.GetAgency(agencyTag, opts...)
 }
 
+func GetAgencyContext(ctx context.Context, agencyTag string, opts...ApiHandlerOption) (*Agency, error) {
+  return DefaultApiHandler.GetAgencyContext(ctx, agencyTag, opts...)
+}
+
 func (a *Agency) GetRoute(routeTag string) (*Route, error) {
-  if a.Routes == nil {
-    _, err := a.GetRoutes()
-    if err != nil {
-      return nil, err
-    }
+  return a.GetRouteContext(a.api.context(), routeTag)
+}
+
+func (a *Agency) GetRouteContext(ctx context.Context, routeTag string) (*Route, error) {
+  routes, err := a.loadedRoutes(ctx)
+  if err != nil {
+    return nil, err
   }
 
-  for _, route := range a.Routes {
+  for _, route := range routes {
     if route.Tag == routeTag {
       return route, nil
     }
@@ -41,13 +55,17 @@ func (a *Agency) GetRoute(routeTag string) (*Route, error) {
 }
 
 func (a *Agency) GetService(svcTag string) (*Service, error) {
-  routes, err := a.GetRoutes()
+  return a.GetServiceContext(a.api.context(), svcTag)
+}
+
+func (a *Agency) GetServiceContext(ctx context.Context, svcTag string) (*Service, error) {
+  routes, err := a.GetRoutesContext(ctx)
   if err != nil {
     return nil, err
   }
 
   for _, route := range routes {
-    svc, err := a.GetServiceByRoute(route.Tag, svcTag)
+    svc, err := a.GetServiceByRouteContext(ctx, route.Tag, svcTag)
     if err != nil {
       continue
     }
@@ -59,7 +77,11 @@ func (a *Agency) GetService(svcTag string) (*Service, error) {
 }
 
 func (a *Agency) GetServiceByRoute(routeTag, svcTag string) (*Service, error) {
-  route, err := a.GetRoute(routeTag)
+  return a.GetServiceByRouteContext(a.api.context(), routeTag, svcTag)
+}
+
+func (a *Agency) GetServiceByRouteContext(ctx context.Context, routeTag, svcTag string) (*Service, error) {
+  route, err := a.GetRouteContext(ctx, routeTag)
   if err != nil {
     return nil, err
   }
@@ -73,64 +95,104 @@ func (a *Agency) GetServiceByRoute(routeTag, svcTag string) (*Service, error) {
 }
 
 func (a *Agency) GetRoutes(opts...ApiHandlerOption) ([]*Route, error) {
-  aho := DefaultApiHandlerOptions
+  return a.GetRoutesContext(a.api.contextFor(opts), opts...)
+}
+
+// GetRoutesContext fetches the config of every route of the agency.
+// Cancelling ctx stops any routeConfig requests not yet made.
+func (a *Agency) GetRoutesContext(ctx context.Context, opts...ApiHandlerOption) ([]*Route, error) {
+  aho := *DefaultApiHandlerOptions
+  for _, opt := range opts {
+    opt(&aho)
+  }
+
+  a.mu.Lock()
+  cached, cacheAge := a.Routes, a.cacheAge
+  a.mu.Unlock()
 
   var useCache bool = aho.UseCache
-  if a.Routes == nil {
+  if cached == nil {
     useCache = false
   }
 
-  if time.Now().Sub(a.cacheAge) > (a.api.cacheMaxAge*time.Second) {
+  if time.Now().Sub(cacheAge) > a.api.cacheMaxAge {
     useCache = false
   }
 
   if useCache {
+    a.api.cacheLookup(ctx, "routes", true, slog.String("agency", a.Tag))
+    return cached, nil
+  }
+  a.api.cacheLookup(ctx, "routes", false, slog.String("agency", a.Tag))
+
+  start := time.Now()
+  rtes, err := a.fetchRoutes(ctx, aho.GetOpts)
+  a.api.logRoutesSpan(ctx, a.Tag, len(rtes), time.Since(start), err)
+  if err != nil {
+    if cached != nil && a.api.serveStale(err) {
+      a.api.cacheLookup(ctx, "stale", true, slog.String("for", "routes"), slog.String("agency", a.Tag))
+      return cached, nil
+    }
+    return nil, err
+  }
+
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  // keep routes another caller fetched meanwhile, so that callers share
+  // the same stops and their prediction caches
+  if a.cacheAge.After(start) {
     return a.Routes, nil
   }
 
-  resp := a.api.Get(MethodRoutes(a.Tag))
-  if resp.Error() != nil {
-    return nil, resp.Error()
+  a.Routes = rtes
+  a.cacheAge = time.Now()
+  return rtes, nil
+}
+
+// the agency's routes, fetched if they haven't been yet
+func (a *Agency) loadedRoutes(ctx context.Context) ([]*Route, error) {
+  a.mu.Lock()
+  routes := a.Routes
+  a.mu.Unlock()
+
+  if routes != nil {
+    return routes, nil
   }
 
-  routes := make([]string, 0)
-  routesIface := make(map[string]interface{})
-  err := json.Unmarshal(resp.Data, &routesIface)
+  return a.GetRoutesContext(ctx)
+}
+
+// fetches the route list and the config of every route on it
+func (a *Agency) fetchRoutes(ctx context.Context, opts []GetOpt) ([]*Route, error) {
+  routesIface, err := a.api.fetch(ctx, MethodRoutes(a.Tag), PriorityBackground, opts...)
   if err != nil {
     return nil, err
   }
 
-  // test if there is only one route 
-  routeList, ok := routesIface["route"]
-  if ok {
-    rl, ok := routeList.([]interface{})
+  routes := make([]string, 0)
+
+  rl, _ := utils.IfaceToSlice(routesIface["route"])
+  for _, v := range rl {
+    rte, ok := v.(map[string]interface{})
     if !ok {
-      rl = []interface{}{routeList.(map[string]interface{})}
+      continue
     }
-
-    for _, v := range rl {
-      rte, ok := v.(map[string]interface{})
-      if !ok {
-        continue
-      }
-      tag, ok := utils.IfaceToString(rte["tag"])
-      if ok {
-        routes = append(routes, tag)
-      }
+    tag, ok := utils.IfaceToString(rte["tag"])
+    if ok {
+      routes = append(routes, tag)
     }
   }
 
-
   rtes := make([]*Route, 0)
 
   for _, r := range routes {
-    resp := a.api.Get(MethodRouteConfig(a.Tag, r))
-    if resp.Error() != nil {
-      return nil, resp.Error()
+    err := ctx.Err()
+    if err != nil {
+      return nil, err
     }
 
-    rIface := make(map[string]interface{})
-    err := json.Unmarshal(resp.Data, &rIface)
+    rIface, err := a.api.fetch(ctx, MethodRouteConfig(a.Tag, r), PriorityBackground, opts...)
     if err != nil {
       return nil, err
     }
@@ -143,21 +205,21 @@ func (a *Agency) GetRoutes(opts...ApiHandlerOption) ([]*Route, error) {
     rtes = append(rtes, rcfg)
   }
 
-  a.Routes = rtes
-  a.cacheAge = time.Now()
-  return rtes, nil 
+  return rtes, nil
 }
 
 func (a *Agency) GetStop(stopId string) (*Stop, error) {
-  if a.Routes == nil {
-    _, err := a.GetRoutes()
-    if err != nil {
-      return nil, errors.New("Could not get stops from routes from api")
-    }
+  return a.GetStopContext(a.api.context(), stopId)
+}
+
+func (a *Agency) GetStopContext(ctx context.Context, stopId string) (*Stop, error) {
+  routes, err := a.loadedRoutes(ctx)
+  if err != nil {
+    return nil, err
   }
 
   stops := make([]*Stop, 0)
-  for _, route := range a.Routes {
+  for _, route := range routes {
     stops = append(stops, route.Stops...)
   }
 
@@ -171,15 +233,17 @@ func (a *Agency) GetStop(stopId string) (*Stop, error) {
 }
 
 func (a *Agency) GetStopRoutes(stopId string) ([]*Route, error) {
-  if a.Routes == nil {
-    _, err := a.GetRoutes()
-    if err != nil {
-      return nil, errors.New("Could not get stops from routes from api")
-    }
+  return a.GetStopRoutesContext(a.api.context(), stopId)
+}
+
+func (a *Agency) GetStopRoutesContext(ctx context.Context, stopId string) ([]*Route, error) {
+  all, err := a.loadedRoutes(ctx)
+  if err != nil {
+    return nil, err
   }
 
   routes := make([]*Route, 0)
-  for _, route := range a.Routes {
+  for _, route := range all {
     stops := make([]string, 0)
     for _, stop := range route.Stops {
       stops = append(stops, stop.StopID)
@@ -193,7 +257,11 @@ func (a *Agency) GetStopRoutes(stopId string) ([]*Route, error) {
 }
 
 func (a *Agency) GetStopServiceRoutes(stopId string) ([]*Service, error) {
-  routes, err := a.GetStopRoutes(stopId)
+  return a.GetStopServiceRoutesContext(a.api.context(), stopId)
+}
+
+func (a *Agency) GetStopServiceRoutesContext(ctx context.Context, stopId string) ([]*Service, error) {
+  routes, err := a.GetStopRoutesContext(ctx, stopId)
   if err != nil {
     return nil, err
   }
@@ -216,7 +284,11 @@ func (a *Agency) GetStopServiceRoutes(stopId string) ([]*Service, error) {
 }
 
 func (a *Agency) GetStops(opts...ApiHandlerOption) ([]*Stop, error) {
-  routes, err := a.GetRoutes(opts...)
+  return a.GetStopsContext(a.api.contextFor(opts), opts...)
+}
+
+func (a *Agency) GetStopsContext(ctx context.Context, opts...ApiHandlerOption) ([]*Stop, error) {
+  routes, err := a.GetRoutesContext(ctx, opts...)
   if err != nil {
     return nil, err
   }
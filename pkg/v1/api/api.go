@@ -1,5 +1,9 @@
 package api
 
+import (
+	"context"
+)
+
 type ApiNotExistErr struct {
   msg string
 }
@@ -12,9 +16,15 @@ func GetAgencies() ([]*Agency, error) {
   return DefaultApiHandler.GetAgencies()
 }
 
+func GetAgenciesContext(ctx context.Context) ([]*Agency, error) {
+  return DefaultApiHandler.GetAgenciesContext(ctx)
+}
+
 type ApiHandlerOptions struct {
   UseCache    bool
   CacheMaxAge int
+  // per-call overrides for the requests made by this call
+  GetOpts     []GetOpt
 }
 
 type ApiHandlerOption func(*ApiHandlerOptions)
@@ -30,3 +40,11 @@ func WithCacheMaxAge(seconds int) ApiHandlerOption {
     a.CacheMaxAge = seconds
   }
 }
+
+// Applies GetOpts to every request made by a higher-level call, eg
+// agency.GetRoutes(WithGetOpts(WithTimeout(5*time.Second))).
+func WithGetOpts(opts...GetOpt) ApiHandlerOption {
+  return func(a *ApiHandlerOptions) {
+    a.GetOpts = append(a.GetOpts, opts...)
+  }
+}
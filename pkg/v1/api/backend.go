@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const xmlFeedPath string = "publicXMLFeed"
+
+// Backend selects which of the feed's formats the handler requests, and
+// decodes responses into the generic object form that Agency, Route,
+// Stop and Prediction are unmarshalled from. Element attributes and
+// children become keys, and element text is stored under "content",
+// matching the layout of the JSON feed.
+type Backend interface {
+  // Name of the feed below the service root, eg "publicJSONFeed"
+  FeedPath() string
+  Decode(data []byte) (map[string]interface{}, error)
+}
+
+// Decodes publicJSONFeed, the default backend
+var JSONBackend Backend = jsonBackend{}
+// Decodes publicXMLFeed. Unlike the JSON feed, lists are always
+// decoded as lists even when they hold a single item.
+var XMLBackend Backend = xmlBackend{}
+
+func WithBackend(b Backend) ApiOption {
+  return func(a *ApiHandler) {
+    a.backend = b
+  }
+}
+
+type jsonBackend struct{}
+
+func (jsonBackend) FeedPath() string {
+  return jsonFeedPath
+}
+
+func (jsonBackend) Decode(data []byte) (map[string]interface{}, error) {
+  iface := make(map[string]interface{})
+  err := json.Unmarshal(data, &iface)
+  if err != nil {
+    return nil, err
+  }
+
+  return iface, nil
+}
+
+type xmlBackend struct{}
+
+func (xmlBackend) FeedPath() string {
+  return xmlFeedPath
+}
+
+// The XML feed wraps every response in a <body> element, whose contents
+// match the top level object of the JSON feed.
+func (xmlBackend) Decode(data []byte) (map[string]interface{}, error) {
+  d := xml.NewDecoder(bytes.NewReader(data))
+  for {
+    tok, err := d.Token()
+    if err == io.EOF {
+      return nil, errors.New("XmlNoRootElementErr")
+    }
+    if err != nil {
+      return nil, err
+    }
+
+    start, ok := tok.(xml.StartElement)
+    if ok {
+      return decodeXMLElement(d, start)
+    }
+  }
+}
+
+func decodeXMLElement(d *xml.Decoder, start xml.StartElement) (map[string]interface{}, error) {
+  el := make(map[string]interface{})
+  for _, attr := range start.Attr {
+    el[attr.Name.Local] = attr.Value
+  }
+
+  var text strings.Builder
+  for {
+    tok, err := d.Token()
+    if err != nil {
+      return nil, err
+    }
+
+    switch t := tok.(type) {
+    case xml.StartElement:
+      child, err := decodeXMLElement(d, t)
+      if err != nil {
+        return nil, err
+      }
+      list, _ := el[t.Name.Local].([]interface{})
+      el[t.Name.Local] = append(list, child)
+    case xml.CharData:
+      text.Write(t)
+    case xml.EndElement:
+      content := strings.TrimSpace(text.String())
+      if content != "" {
+        el["content"] = content
+      }
+      return el, nil
+    }
+  }
+}
+
+// decodes the body of resp with the handler's backend. The result is
+// kept on the response so that it is only decoded once, even when the
+// response is shared by coalesced requests.
+func (a *ApiHandler) decode(m ApiMethod, resp *ApiResponse) (map[string]interface{}, error) {
+  resp.decodeOnce.Do(func() {
+    body, err := a.backend.Decode(resp.Data)
+    if err != nil {
+      resp.decodeErr = &DecodeError{Command: m.Command, Err: err}
+      return
+    }
+
+    resp.body = body
+  })
+
+  return resp.body, resp.decodeErr
+}
@@ -0,0 +1,271 @@
+package api_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+)
+
+var backends = []api.Backend{api.JSONBackend, api.XMLBackend}
+
+var parityClock = time.Date(2024, time.March, 5, 17, 0, 0, 0, time.UTC)
+
+// One agency, so the agency list collapses in the JSON feed. Route J has
+// a single stop, direction and prediction, which collapse as well, and
+// stop "judah" on route N has no predictions.
+func parityFeed() *apitest.Feed {
+  return &apitest.Feed{
+    Agencies: []*apitest.Agency{{
+      Tag: "sf-muni",
+      Title: "San Francisco Muni",
+      ShortTitle: "SF Muni",
+      RegionTitle: "California-Northern",
+      Routes: []*apitest.Route{
+        {
+          Tag: "N",
+          Title: "N-Judah",
+          ShortTitle: "N",
+          Stops: []*apitest.Stop{
+            {Tag: "5240", StopID: "15240", Title: "Carl St & Cole St", ShortTitle: "Carl & Cole", Lat: 37.7656, Lon: -122.4497},
+            {Tag: "judah", StopID: "14448", Title: "Judah St & 9th Ave", Lat: 37.7622, Lon: -122.4663},
+            {Tag: "notid", Title: "Ocean Beach", Lat: 37.7603, Lon: -122.5087},
+          },
+          Directions: []*apitest.Direction{
+            {Tag: "N__OB1", Title: "Outbound to Ocean Beach", Name: "Outbound", UseForUI: true, Stops: []string{"5240", "judah", "notid"}},
+            {Tag: "N__IB1", Title: "Inbound to Caltrain", Name: "Inbound", UseForUI: true, Stops: []string{"notid", "judah", "5240"}},
+          },
+        },
+        {
+          Tag: "J",
+          Title: "J-Church",
+          Stops: []*apitest.Stop{
+            {Tag: "4006", StopID: "14006", Title: "Church St & Duboce Ave", Lat: 37.7693, Lon: -122.4290},
+          },
+          Directions: []*apitest.Direction{
+            {Tag: "J__OB1", Title: "Outbound to Balboa Park", Name: "Outbound", UseForUI: true, Stops: []string{"4006"}},
+          },
+        },
+      },
+      Predictions: []*apitest.Prediction{
+        {Route: "N", Direction: "N__OB1", Stop: "5240", Seconds: 125, Vehicle: "1501", Block: "9701", TripTag: "t1", VehiclesInConsist: 2, IsDeparture: true},
+        {Route: "N", Direction: "N__OB1", Stop: "5240", Seconds: 845, Vehicle: "1520", ScheduleBased: true, AffectedByLayover: true},
+        {Route: "N", Direction: "N__IB1", Stop: "5240", Seconds: 300, Vehicle: "1533", Slowness: 0.25, Delayed: true, Branch: "N1"},
+        {Route: "J", Direction: "J__OB1", Stop: "4006", Seconds: 60, Vehicle: "1410"},
+      },
+    }},
+  }
+}
+
+// a text form of the model, covering every field the feed fills
+func snapshotAgency(a *api.Agency) string {
+  var b strings.Builder
+  fmt.Fprintf(&b, "agency %q %q %q %q %s\n", a.Tag, a.Title, a.ShortTitle, a.RegionTitle, a.Location)
+  for _, r := range a.Routes {
+    fmt.Fprintf(&b, "route %q %q %q\n", r.Tag, r.Title, r.ShortTitle)
+    for _, s := range r.Stops {
+      fmt.Fprintf(&b, "  %s\n", snapshotStop(s))
+    }
+    for _, svc := range r.Services {
+      tags := make([]string, 0, len(svc.Stops))
+      for _, s := range svc.Stops {
+        tags = append(tags, s.Tag)
+      }
+      fmt.Fprintf(&b, "  service %q %q %q %v %v\n", svc.Tag, svc.Name, svc.Title, svc.UseForUI, tags)
+    }
+  }
+
+  return b.String()
+}
+
+func snapshotStop(s *api.Stop) string {
+  return fmt.Sprintf("stop %q %q %q %q %v %v", s.Tag, s.StopID, s.Title, s.ShortTitle, s.Latitude, s.Longitude)
+}
+
+func snapshotPredictions(preds []*api.Prediction) string {
+  var b strings.Builder
+  for _, p := range preds {
+    fmt.Fprintf(&b, "%s %s %s %s %d %d %q %v %v %q %v %v %q %q %d %v\n",
+      p.Route.Tag, p.Service.Tag, p.Stop.Tag, p.Eta.Format(time.RFC3339), p.Minutes, p.Seconds,
+      p.Branch, p.AffectedByLayover, p.IsDeparture, p.TripTag, p.ScheduleBased, p.Delayed,
+      p.VehicleID, p.Block, p.VehiclesInConsist, p.Slowness)
+  }
+
+  return b.String()
+}
+
+// runs fn against the feed once per backend, returning what it produced
+// for each
+func perBackend(t *testing.T, srv *apitest.Server, fn func(t *testing.T, h *api.ApiHandler) string) []string {
+  out := make([]string, 0, len(backends))
+  for _, b := range backends {
+    h := srv.ApiHandler(api.WithBackend(b))
+    out = append(out, fn(t, h))
+  }
+
+  return out
+}
+
+func assertParity(t *testing.T, got []string) {
+  t.Helper()
+  for i := 1; i < len(got); i++ {
+    if got[i] != got[0] {
+      t.Errorf("%s differs from %s:\n%s\nwant:\n%s", backends[i].FeedPath(), backends[0].FeedPath(), got[i], got[0])
+    }
+  }
+}
+
+func mustAgency(t *testing.T, h *api.ApiHandler) *api.Agency {
+  t.Helper()
+  agency, err := h.GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = agency.GetRoutes()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return agency
+}
+
+func TestBackendParityModel(t *testing.T) {
+  srv := apitest.NewServer(parityFeed(), apitest.WithClock(func() time.Time { return parityClock }))
+  defer srv.Close()
+
+  got := perBackend(t, srv, func(t *testing.T, h *api.ApiHandler) string {
+    agency := mustAgency(t, h)
+
+    // single item lists must not be lost to the JSON feed's collapse
+    j, err := agency.GetRoute("J")
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(j.Stops) != 1 || len(j.Services) != 1 || len(j.Services[0].Stops) != 1 {
+      t.Errorf("route J has %d stops and %d services, want 1 of each", len(j.Stops), len(j.Services))
+    }
+
+    return snapshotAgency(agency)
+  })
+
+  assertParity(t, got)
+
+  want := "route \"N\" \"N-Judah\" \"N\"\n" +
+    "  stop \"5240\" \"15240\" \"Carl St & Cole St\" \"Carl & Cole\" 37.7656 -122.4497\n"
+  if !strings.Contains(got[0], want) {
+    t.Errorf("model missing %q:\n%s", want, got[0])
+  }
+  if !strings.Contains(got[0], "America/Los_Angeles") {
+    t.Errorf("agency location not taken from its region:\n%s", got[0])
+  }
+}
+
+func TestBackendParityPredictions(t *testing.T) {
+  srv := apitest.NewServer(parityFeed(), apitest.WithClock(func() time.Time { return parityClock }))
+  defer srv.Close()
+
+  got := perBackend(t, srv, func(t *testing.T, h *api.ApiHandler) string {
+    agency := mustAgency(t, h)
+
+    var b strings.Builder
+    for _, stopId := range []string{"15240", "14006"} {
+      stop, err := agency.GetStop(stopId)
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      preds, err := stop.GetPredictions()
+      if err != nil {
+        t.Fatal(err)
+      }
+      b.WriteString(snapshotPredictions(preds))
+    }
+
+    return b.String()
+  })
+
+  assertParity(t, got)
+
+  lines := strings.Split(strings.TrimSpace(got[0]), "\n")
+  if len(lines) != 4 {
+    t.Fatalf("got %d predictions, want 4:\n%s", len(lines), got[0])
+  }
+  want := "J J__OB1 4006 2024-03-05T09:01:00-08:00 1 60 \"\" false false \"\" false false \"1410\" \"\" 0 0"
+  if lines[3] != want {
+    t.Errorf("single prediction decoded as\n%s\nwant\n%s", lines[3], want)
+  }
+}
+
+func TestBackendParityNoPredictions(t *testing.T) {
+  srv := apitest.NewServer(parityFeed(), apitest.WithClock(func() time.Time { return parityClock }))
+  defer srv.Close()
+
+  got := perBackend(t, srv, func(t *testing.T, h *api.ApiHandler) string {
+    agency := mustAgency(t, h)
+    stop, err := agency.GetStop("14448")
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    preds, err := stop.GetPredictions()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(preds) != 0 {
+      t.Errorf("got %d predictions, want none", len(preds))
+    }
+
+    sp, err := stop.GetPredictionStatus()
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    var b strings.Builder
+    for _, rp := range sp.Routes {
+      fmt.Fprintf(&b, "%s %q %q %s %q\n", rp.RouteTag, rp.RouteTitle, rp.StopTitle, rp.Status, rp.DirectionTitle)
+    }
+
+    return b.String()
+  })
+
+  assertParity(t, got)
+
+  want := "N \"N-Judah\" \"Judah St & 9th Ave\" no_predictions \"Outbound to Ocean Beach\"\n"
+  if got[0] != want {
+    t.Errorf("got\n%s\nwant\n%s", got[0], want)
+  }
+}
+
+func TestBackendParityFeedError(t *testing.T) {
+  srv := apitest.NewServer(parityFeed())
+  defer srv.Close()
+
+  srv.Fault("routeConfig", apitest.Fault{Message: "Could not get route \"N\" for agency tag \"sf-muni\"."})
+
+  got := perBackend(t, srv, func(t *testing.T, h *api.ApiHandler) string {
+    agency, err := h.GetAgency("sf-muni")
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    _, err = agency.GetRoutes()
+    var fe *api.FeedError
+    if !errors.As(err, &fe) {
+      t.Fatalf("got %v, want a FeedError", err)
+    }
+
+    return fmt.Sprintf("%s %q %v", fe.Command, fe.Message, fe.ShouldRetry)
+  })
+
+  assertParity(t, got)
+
+  want := "routeConfig \"Could not get route \\\"N\\\" for agency tag \\\"sf-muni\\\".\" false"
+  if got[0] != want {
+    t.Errorf("got %s, want %s", got[0], want)
+  }
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of an ApiHandler's circuit breaker.
+type CircuitState int
+
+const (
+  // requests flow normally
+  CircuitClosed CircuitState = iota
+  // requests fail fast with a CircuitOpenError
+  CircuitOpen
+  // a limited number of trial requests decide whether to close or
+  // reopen the circuit
+  CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+  switch s {
+  case CircuitClosed:
+    return "closed"
+  case CircuitOpen:
+    return "open"
+  case CircuitHalfOpen:
+    return "half_open"
+  }
+
+  return "unknown"
+}
+
+// CircuitBreakerConfig configures the breaker that stops an ApiHandler
+// from adding load to the feed during an outage. Only transport errors
+// and 5xx responses count as failures, feed errors show the feed is up.
+type CircuitBreakerConfig struct {
+  // Consecutive failed attempts that open the circuit, 0 to disable
+  ConsecutiveFailures int
+  // Fraction (0-1) of failed attempts within Window that opens the
+  // circuit, 0 to disable
+  FailureRate         float64
+  // Attempts that must be made within Window before FailureRate is
+  // considered
+  MinRequests         int
+  Window              time.Duration
+  // How long the circuit stays open before trial requests are allowed
+  OpenFor             time.Duration
+  // Trial requests allowed at once while half-open, all must succeed
+  // for the circuit to close
+  HalfOpenRequests    int
+  // Answer calls that keep a cache, such as GetAgencies, Agency.GetRoutes
+  // and Stop.GetPredictions, from stale cached data while the circuit is
+  // open instead of returning a CircuitOpenError
+  FallbackToCache     bool
+  // Called after every state change, eg to alert. It must not block.
+  OnStateChange       func(from, to CircuitState)
+}
+
+var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
+  ConsecutiveFailures: 5,
+  FailureRate: 0.5,
+  MinRequests: 10,
+  Window: time.Minute,
+  OpenFor: 30*time.Second,
+  HalfOpenRequests: 1,
+}
+
+// Adds a circuit breaker to the handler. The breaker sits in front of
+// every attempt, so retries stop as soon as it opens. It is shared by
+// every endpoint, and can open before WithFailover would have moved on.
+func WithCircuitBreaker(cfg CircuitBreakerConfig) ApiOption {
+  return func(a *ApiHandler) {
+    a.breaker = newCircuitBreaker(cfg)
+  }
+}
+
+// Reports the state of the handler's circuit breaker, always
+// CircuitClosed if it has none.
+func (a *ApiHandler) CircuitState() CircuitState {
+  if a.breaker == nil {
+    return CircuitClosed
+  }
+
+  return a.breaker.current()
+}
+
+// CircuitOpenError is returned instead of making a request while the
+// circuit breaker is open.
+type CircuitOpenError struct {
+  Command string
+  // When trial requests will next be allowed
+  Until   time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+  return fmt.Sprintf("umoiq circuit open for command %s until %s", e.Command, e.Until.Format(time.RFC3339))
+}
+
+type circuitOutcome struct {
+  at     time.Time
+  failed bool
+}
+
+type stateChange struct {
+  from, to CircuitState
+}
+
+type circuitBreaker struct {
+  mu        sync.Mutex
+  cfg       CircuitBreakerConfig
+  state     CircuitState
+  // consecutive failures while closed
+  failures  int
+  // attempts made within the window while closed
+  outcomes  []circuitOutcome
+  openedAt  time.Time
+  // trial requests in flight and succeeded while half-open
+  trials    int
+  successes int
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+  if cfg.OpenFor <= 0 {
+    cfg.OpenFor = DefaultCircuitBreakerConfig.OpenFor
+  }
+  if cfg.HalfOpenRequests <= 0 {
+    cfg.HalfOpenRequests = 1
+  }
+
+  return &circuitBreaker{cfg: cfg}
+}
+
+func (b *circuitBreaker) current() CircuitState {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  return b.state
+}
+
+// reports whether an attempt may be made now and whether it is a trial
+// request, and if not allowed when the circuit will allow trial requests
+func (b *circuitBreaker) allow() (bool, bool, time.Time, *stateChange) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  var change *stateChange
+  until := b.openedAt.Add(b.cfg.OpenFor)
+  if b.state == CircuitOpen {
+    if time.Now().Before(until) {
+      return false, false, until, nil
+    }
+    change = b.set(CircuitHalfOpen)
+  }
+
+  if b.state == CircuitHalfOpen {
+    if b.trials >= b.cfg.HalfOpenRequests {
+      return false, false, until, change
+    }
+    b.trials++
+    return true, true, time.Time{}, change
+  }
+
+  return true, false, time.Time{}, change
+}
+
+// records the outcome of an allowed attempt. Attempts abandoned by the
+// caller are not counted, but release their trial slot.
+func (b *circuitBreaker) record(trial, failed, counted bool) *stateChange {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  switch {
+  case trial && b.state == CircuitHalfOpen:
+    b.trials--
+    if !counted {
+      return nil
+    }
+    if failed {
+      return b.set(CircuitOpen)
+    }
+    b.successes++
+    if b.successes >= b.cfg.HalfOpenRequests {
+      return b.set(CircuitClosed)
+    }
+  case !trial && b.state == CircuitClosed:
+    if !counted {
+      return nil
+    }
+    return b.recordClosed(failed)
+  }
+
+  // attempts that finish after the circuit changed state tell us
+  // nothing new
+  return nil
+}
+
+func (b *circuitBreaker) recordClosed(failed bool) *stateChange {
+  now := time.Now()
+  b.outcomes = append(b.outcomes, circuitOutcome{at: now, failed: failed})
+  i := 0
+  for i < len(b.outcomes) && now.Sub(b.outcomes[i].at) > b.cfg.Window {
+    i++
+  }
+  b.outcomes = b.outcomes[i:]
+
+  if !failed {
+    b.failures = 0
+    return nil
+  }
+  b.failures++
+
+  if b.cfg.ConsecutiveFailures > 0 && b.failures >= b.cfg.ConsecutiveFailures {
+    return b.set(CircuitOpen)
+  }
+
+  if b.cfg.FailureRate > 0 && len(b.outcomes) >= b.cfg.MinRequests {
+    n := 0
+    for _, o := range b.outcomes {
+      if o.failed {
+        n++
+      }
+    }
+    if float64(n)/float64(len(b.outcomes)) >= b.cfg.FailureRate {
+      return b.set(CircuitOpen)
+    }
+  }
+
+  return nil
+}
+
+// moves to state s, resetting the counters of the state we leave.
+// Must be called with mu held.
+func (b *circuitBreaker) set(s CircuitState) *stateChange {
+  change := &stateChange{from: b.state, to: s}
+  b.state = s
+  b.failures = 0
+  b.outcomes = nil
+  b.trials = 0
+  b.successes = 0
+  if s == CircuitOpen {
+    b.openedAt = time.Now()
+  }
+
+  return change
+}
+
+// gives back a trial slot taken by an attempt that was never made
+func (a *ApiHandler) releaseBreaker(ctx context.Context, trial bool) {
+  if a.breaker != nil {
+    a.circuitChanged(ctx, a.breaker.record(trial, false, false))
+  }
+}
+
+// logs a state change and passes it on to the configured callback
+func (a *ApiHandler) circuitChanged(ctx context.Context, change *stateChange) {
+  if change == nil {
+    return
+  }
+
+  level := slog.LevelInfo
+  if change.to == CircuitOpen {
+    level = slog.LevelWarn
+  }
+  if a.logEnabled(ctx, level) {
+    a.logger.LogAttrs(ctx, level, "umoiq circuit state changed",
+      slog.String("from", change.from.String()),
+      slog.String("to", change.to.String()),
+    )
+  }
+
+  if a.breaker.cfg.OnStateChange != nil {
+    a.breaker.cfg.OnStateChange(change.from, change.to)
+  }
+}
+
+// reports whether a call that failed with err should be answered from
+// its stale cache instead
+func (a *ApiHandler) serveStale(err error) bool {
+  var coe *CircuitOpenError
+  return a.breaker != nil && a.breaker.cfg.FallbackToCache && errors.As(err, &coe)
+}
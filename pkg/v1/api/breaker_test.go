@@ -0,0 +1,261 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const agencyListJSON string = `{"agency":{"tag":"sf-muni","title":"San Francisco Muni","regionTitle":"California-Northern"}}`
+
+// a handler sending every request to serve, without retries or rate
+// limiting unless opts add them
+func newTestHandler(t *testing.T, serve http.HandlerFunc, opts...ApiOption) *ApiHandler {
+  t.Helper()
+
+  srv := httptest.NewServer(serve)
+  t.Cleanup(srv.Close)
+
+  base := []ApiOption{
+    WithBaseURL(srv.URL),
+    WithoutRateLimit(),
+  }
+
+  return NewApiHandler(&GetConfig{
+    Timeout: 5*time.Second,
+    RetryDelay: 50*time.Millisecond,
+  }, append(base, opts...)...)
+}
+
+// serves the agency list, or a 503 while failing is set
+func flakyFeed(failing *atomic.Bool, requests *atomic.Int32) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    requests.Add(1)
+    if failing.Load() {
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    w.Write([]byte(agencyListJSON))
+  }
+}
+
+// runs outcomes through the breaker as closed-state attempts, true
+// meaning failed, and returns the state it ends in
+func runOutcomes(b *circuitBreaker, outcomes []bool) CircuitState {
+  for _, failed := range outcomes {
+    ok, trial, _, _ := b.allow()
+    if !ok {
+      break
+    }
+    b.record(trial, failed, true)
+  }
+
+  return b.current()
+}
+
+func TestCircuitBreakerTrips(t *testing.T) {
+  const F, S = true, false
+
+  tests := []struct {
+    name     string
+    cfg      CircuitBreakerConfig
+    outcomes []bool
+    want     CircuitState
+  }{
+    {"consecutive failures", CircuitBreakerConfig{ConsecutiveFailures: 3}, []bool{F, F, F}, CircuitOpen},
+    {"success resets the run", CircuitBreakerConfig{ConsecutiveFailures: 3}, []bool{F, F, S, F, F}, CircuitClosed},
+    {"rate below MinRequests", CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute}, []bool{F, S, F}, CircuitClosed},
+    {"rate at MinRequests", CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute}, []bool{S, F, S, F}, CircuitOpen},
+    {"rate under threshold", CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute}, []bool{S, S, F, S, F}, CircuitClosed},
+    {"both disabled", CircuitBreakerConfig{}, []bool{F, F, F, F, F, F, F, F, F, F}, CircuitClosed},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      b := newCircuitBreaker(tt.cfg)
+      if got := runOutcomes(b, tt.outcomes); got != tt.want {
+        t.Errorf("got %s, want %s", got, tt.want)
+      }
+    })
+  }
+}
+
+// Outcomes older than the window don't count towards the failure rate.
+func TestCircuitBreakerWindow(t *testing.T) {
+  b := newCircuitBreaker(CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 3, Window: 20*time.Millisecond})
+
+  runOutcomes(b, []bool{true, true})
+  time.Sleep(30*time.Millisecond)
+  if got := runOutcomes(b, []bool{false, false, true}); got != CircuitClosed {
+    t.Errorf("got %s with 1 of 3 recent attempts failed, want closed", got)
+  }
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+  tests := []struct {
+    name   string
+    trials []bool
+    want   CircuitState
+  }{
+    {"all trials succeed", []bool{false, false}, CircuitClosed},
+    {"a trial fails", []bool{false, true}, CircuitOpen},
+    {"first trial fails", []bool{true}, CircuitOpen},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      b := newCircuitBreaker(CircuitBreakerConfig{ConsecutiveFailures: 1, OpenFor: 20*time.Millisecond, HalfOpenRequests: 2})
+      runOutcomes(b, []bool{true})
+
+      ok, _, until, _ := b.allow()
+      if ok || until.IsZero() {
+        t.Fatalf("open circuit allowed an attempt")
+      }
+
+      time.Sleep(30*time.Millisecond)
+      ok, trial, _, change := b.allow()
+      if !ok || !trial || change == nil || change.to != CircuitHalfOpen {
+        t.Fatalf("got allowed %v trial %v change %v after OpenFor", ok, trial, change)
+      }
+      ok, _, _, _ = b.allow()
+      if !ok {
+        t.Fatalf("second trial slot not given")
+      }
+      ok, _, _, _ = b.allow()
+      if ok {
+        t.Fatalf("third attempt allowed with 2 trial slots")
+      }
+
+      for _, failed := range tt.trials {
+        b.record(true, failed, true)
+      }
+      if got := b.current(); got != tt.want {
+        t.Errorf("got %s, want %s", got, tt.want)
+      }
+    })
+  }
+}
+
+// State changes are reported in order, and while open, calls with a
+// cache answer from it.
+func TestCircuitBreakerHandler(t *testing.T) {
+  var failing atomic.Bool
+  var requests atomic.Int32
+
+  var mu sync.Mutex
+  changes := make([]string, 0)
+  h := newTestHandler(t, flakyFeed(&failing, &requests), WithCircuitBreaker(CircuitBreakerConfig{
+    ConsecutiveFailures: 2,
+    OpenFor: 50*time.Millisecond,
+    FallbackToCache: true,
+    OnStateChange: func(from, to CircuitState) {
+      mu.Lock()
+      defer mu.Unlock()
+      changes = append(changes, from.String()+">"+to.String())
+    },
+  }))
+
+  _, err := h.GetAgencies()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  failing.Store(true)
+  for i := 0; i < 2; i++ {
+    h.Get(MethodAgencyList())
+  }
+  if h.CircuitState() != CircuitOpen {
+    t.Fatalf("got %s after 2 failures, want open", h.CircuitState())
+  }
+
+  n := requests.Load()
+  resp := h.Get(MethodAgencyList())
+  var coe *CircuitOpenError
+  if !errors.As(resp.Error(), &coe) {
+    t.Errorf("got %v, want a CircuitOpenError", resp.Error())
+  }
+  if requests.Load() != n {
+    t.Errorf("open circuit made a request")
+  }
+
+  agencies, err := h.GetAgencies(WithoutCache())
+  if err != nil || len(agencies) != 1 {
+    t.Errorf("got %d agencies and %v, want the stale cache", len(agencies), err)
+  }
+
+  failing.Store(false)
+  time.Sleep(60*time.Millisecond)
+  resp = h.Get(MethodAgencyList())
+  if resp.Error() != nil {
+    t.Fatal(resp.Error())
+  }
+  if h.CircuitState() != CircuitClosed {
+    t.Errorf("got %s after a successful trial, want closed", h.CircuitState())
+  }
+
+  mu.Lock()
+  defer mu.Unlock()
+  want := []string{"closed>open", "open>half_open", "half_open>closed"}
+  if len(changes) != len(want) {
+    t.Fatalf("got changes %v, want %v", changes, want)
+  }
+  for i := range want {
+    if changes[i] != want[i] {
+      t.Errorf("got changes %v, want %v", changes, want)
+      break
+    }
+  }
+}
+
+// A trial request the caller gives up on frees its slot without
+// deciding the circuit.
+func TestCircuitBreakerTrialCancelled(t *testing.T) {
+  var failing, hanging atomic.Bool
+  var requests atomic.Int32
+  feed := flakyFeed(&failing, &requests)
+
+  h := newTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+    if hanging.Load() {
+      select {
+      case <-r.Context().Done():
+      case <-time.After(5*time.Second):
+      }
+      return
+    }
+    feed(w, r)
+  }, WithCircuitBreaker(CircuitBreakerConfig{ConsecutiveFailures: 1, OpenFor: 20*time.Millisecond}))
+
+  failing.Store(true)
+  h.Get(MethodAgencyList())
+  if h.CircuitState() != CircuitOpen {
+    t.Fatalf("got %s, want open", h.CircuitState())
+  }
+
+  failing.Store(false)
+  hanging.Store(true)
+  time.Sleep(30*time.Millisecond)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+  resp := h.GetContext(ctx, MethodAgencyList())
+  if !isContextErr(resp.Error()) {
+    t.Fatalf("got %v, want the context's error", resp.Error())
+  }
+  if h.CircuitState() != CircuitHalfOpen {
+    t.Errorf("got %s after an abandoned trial, want half_open", h.CircuitState())
+  }
+
+  hanging.Store(false)
+  resp = h.Get(MethodAgencyList())
+  if resp.Error() != nil {
+    t.Fatalf("got %v, want the freed slot to be used", resp.Error())
+  }
+  if h.CircuitState() != CircuitClosed {
+    t.Errorf("got %s, want closed", h.CircuitState())
+  }
+}
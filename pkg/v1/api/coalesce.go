@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// an in-flight request that identical requests wait on
+type flightCall struct {
+  done chan struct{}
+  resp *ApiResponse
+}
+
+// flightGroup coalesces concurrent identical requests so that only one
+// of them reaches the feed, and the rest share its response.
+type flightGroup struct {
+  mu    sync.Mutex
+  calls map[string]*flightCall
+  saved atomic.Int64
+}
+
+// runs fn for key, unless a call for key is already in flight, in which
+// case its response is waited for and returned instead, and shared is true.
+// Waiting stops if ctx is cancelled first, shared is then false as no
+// response was shared.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() *ApiResponse) (resp *ApiResponse, shared bool) {
+  g.mu.Lock()
+  if g.calls == nil {
+    g.calls = make(map[string]*flightCall)
+  }
+
+  call, ok := g.calls[key]
+  if ok {
+    g.mu.Unlock()
+    select {
+    case <-call.done:
+      return call.resp, true
+    case <-ctx.Done():
+      return &ApiResponse{err: ctx.Err()}, false
+    }
+  }
+
+  call = &flightCall{done: make(chan struct{})}
+  g.calls[key] = call
+  g.mu.Unlock()
+
+  defer func() {
+    g.mu.Lock()
+    delete(g.calls, key)
+    g.mu.Unlock()
+    close(call.done)
+  }()
+
+  call.resp = fn()
+  return call.resp, false
+}
+
+// Reports how many requests were answered by sharing the response of an
+// identical request already in flight, rather than calling the feed.
+// Shared responses are the same *ApiResponse, and must not be modified.
+func (a *ApiHandler) CoalescedRequests() int64 {
+  return a.flights.saved.Load()
+}
+
+// requests are identical if they resolve to the same method and send the
+// same headers, other per-call options don't change the response
+func flightKey(m ApiMethod, cfg *GetConfig) string {
+  key := m.Key()
+  if len(cfg.CustomHeaders) == 0 {
+    return key
+  }
+
+  names := make([]string, 0, len(cfg.CustomHeaders))
+  for k := range cfg.CustomHeaders {
+    names = append(names, k)
+  }
+  sort.Strings(names)
+
+  for _, k := range names {
+    key += "\x00" + k + ":" + cfg.CustomHeaders[k]
+  }
+
+  return key
+}
+
+func isContextErr(err error) bool {
+  return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
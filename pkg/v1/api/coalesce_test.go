@@ -0,0 +1,178 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+)
+
+const cannedMessages string = `{"route":{"tag":"all","message":{"id":"1","priority":"Normal","text":"Elevator out of service"}}}`
+
+// answers messages requests itself after a delay, before the built-in
+// decoding layer sees the response
+func slowMessages(delay time.Duration) api.Middleware {
+  return func(next api.RequestHandler) api.RequestHandler {
+    return func(m api.ApiMethod, req *http.Request) *api.ApiResponse {
+      if m.Command != "messages" {
+        return next(m, req)
+      }
+
+      time.Sleep(delay)
+      resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+      return api.NewApiResponse(resp, []byte(cannedMessages), nil)
+    }
+  }
+}
+
+// Callers sharing a response that was never decoded by the chain decode
+// it concurrently, run with -race.
+func TestCoalescedDecode(t *testing.T) {
+  srv := apitest.NewServer(parityFeed())
+  defer srv.Close()
+
+  h := srv.ApiHandler(api.WithMiddleware(slowMessages(200*time.Millisecond)))
+  agency, err := h.GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var wg sync.WaitGroup
+  errs := make([]error, 8)
+  for i := range errs {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+
+      msgs, err := agency.GetMessages()
+      if err == nil && (len(msgs) != 1 || msgs[0].Text != "Elevator out of service") {
+        t.Errorf("got %d messages", len(msgs))
+      }
+      errs[i] = err
+    }(i)
+  }
+  wg.Wait()
+
+  for _, err := range errs {
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  if h.CoalescedRequests() == 0 {
+    t.Errorf("no requests were coalesced")
+  }
+}
+
+// A caller that stops waiting on a shared request didn't use its
+// response, and isn't counted as saved.
+func TestCoalescedGiveUp(t *testing.T) {
+  srv := apitest.NewServer(parityFeed())
+  defer srv.Close()
+
+  h := srv.ApiHandler(api.WithMiddleware(slowMessages(200*time.Millisecond)))
+  agency, err := h.GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  done := make(chan error)
+  go func() {
+    _, err := agency.GetMessages()
+    done <- err
+  }()
+
+  time.Sleep(50*time.Millisecond)
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+
+  _, err = agency.GetMessagesContext(ctx)
+  if err == nil {
+    t.Errorf("waiter returned before the shared request finished")
+  }
+
+  err = <-done
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if n := h.CoalescedRequests(); n != 0 {
+    t.Errorf("got %d coalesced requests, want 0", n)
+  }
+}
+
+// runs f from n goroutines at once, failing on the first error
+func concurrently(t *testing.T, n int, f func() error) {
+  t.Helper()
+
+  var wg sync.WaitGroup
+  errs := make([]error, n)
+  for i := range errs {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      errs[i] = f()
+    }(i)
+  }
+  wg.Wait()
+
+  for _, err := range errs {
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+// Callers sharing a request all store its result in the handler's
+// cache, run with -race.
+func TestConcurrentGetAgencies(t *testing.T) {
+  srv := apitest.NewServer(parityFeed())
+  defer srv.Close()
+
+  h := srv.ApiHandler()
+  concurrently(t, 20, func() error {
+    agencies, err := h.GetAgencies()
+    if err == nil && len(agencies) != 1 {
+      t.Errorf("got %d agencies", len(agencies))
+    }
+    return err
+  })
+
+  if n := srv.Requests("agencyList"); n != 1 {
+    t.Errorf("feed got %d agencyList requests, want 1", n)
+  }
+}
+
+// As above, for the route and prediction caches of an agency and stop.
+func TestConcurrentStopPredictions(t *testing.T) {
+  srv := apitest.NewServer(parityFeed())
+  defer srv.Close()
+
+  h := srv.ApiHandler()
+  agency, err := h.GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  concurrently(t, 20, func() error {
+    stop, err := agency.GetStop("15240")
+    if err != nil {
+      return err
+    }
+
+    preds, err := stop.GetPredictions()
+    if err == nil && len(preds) == 0 {
+      t.Errorf("got no predictions")
+    }
+    if err != nil {
+      return err
+    }
+
+    _, err = stop.GetRoutePredictions("N")
+    return err
+  })
+}
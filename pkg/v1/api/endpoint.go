@@ -0,0 +1,128 @@
+package api
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Root of the UmoIQ feed service, the feeds themselves are served
+// below it (eg API_URI)
+const API_BASE_URI string = "https://retro.umoiq.com/service"
+// Root of the legacy NextBus feed service
+const LEGACY_API_BASE_URI string = "https://webservices.nextbus.com/service"
+
+// How long an endpoint must keep failing before the handler moves on
+// to the next one
+const DefaultFailoverAfter time.Duration = 30*time.Second
+// How long the handler stays on a fallback before trying the primary
+// endpoint again
+const DefaultFailbackAfter time.Duration = 5*time.Minute
+
+// Points the handler at a different feed service, eg a caching mirror
+// or a local test server. base is the service root that the feed path
+// is appended to, such as API_BASE_URI. Fallbacks are tried in order
+// when the current endpoint keeps failing.
+func WithBaseURL(base string, fallbacks ...string) ApiOption {
+  return func(a *ApiHandler) {
+    a.endpoints = newEndpointSet(append([]string{base}, fallbacks...))
+  }
+}
+
+// Sets how long transport errors or 5xx responses must persist before
+// failing over to the next endpoint, and how long to wait before trying
+// the primary endpoint again.
+func WithFailover(after, failback time.Duration) ApiOption {
+  return func(a *ApiHandler) {
+    a.failoverAfter = after
+    a.failbackAfter = failback
+  }
+}
+
+// Reports the base URL requests are currently sent to.
+func (a *ApiHandler) CurrentEndpoint() string {
+  return a.endpoints.current()
+}
+
+type endpoint struct {
+  base         string
+  // zero while the endpoint is healthy
+  failingSince time.Time
+}
+
+type endpointSet struct {
+  mu         sync.Mutex
+  endpoints  []*endpoint
+  idx        int
+  // when we last moved off the primary endpoint
+  failedOver time.Time
+}
+
+func newEndpointSet(bases []string) *endpointSet {
+  s := &endpointSet{
+    endpoints: make([]*endpoint, 0, len(bases)),
+  }
+
+  for _, b := range bases {
+    s.endpoints = append(s.endpoints, &endpoint{
+      base: strings.TrimRight(b, "/"),
+    })
+  }
+
+  return s
+}
+
+func (s *endpointSet) current() string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return s.endpoints[s.idx].base
+}
+
+// picks the endpoint for the next request, moving back to the primary
+// once failback has passed since we failed over
+func (s *endpointSet) pick(failback time.Duration) string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.idx != 0 && failback > 0 && time.Since(s.failedOver) > failback {
+    s.idx = 0
+    s.endpoints[0].failingSince = time.Time{}
+  }
+
+  return s.endpoints[s.idx].base
+}
+
+// records the outcome of a request made to base. Once the current
+// endpoint has been failing for longer than after, the next one is used.
+func (s *endpointSet) report(base string, failed bool, after time.Duration) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  cur := s.endpoints[s.idx]
+  if cur.base != base {
+    // a request that started before we switched endpoints
+    return
+  }
+
+  if !failed {
+    cur.failingSince = time.Time{}
+    return
+  }
+
+  now := time.Now()
+  if cur.failingSince.IsZero() {
+    cur.failingSince = now
+  }
+
+  if len(s.endpoints) < 2 || now.Sub(cur.failingSince) < after {
+    return
+  }
+
+  cur.failingSince = time.Time{}
+  s.idx = (s.idx+1) % len(s.endpoints)
+  s.endpoints[s.idx].failingSince = time.Time{}
+  if s.idx != 0 {
+    s.failedOver = now
+  }
+}
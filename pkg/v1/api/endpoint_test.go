@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndpointFailover(t *testing.T) {
+  type report struct {
+    base   string
+    failed bool
+  }
+
+  tests := []struct {
+    name    string
+    bases   []string
+    after   time.Duration
+    reports []report
+    want    string
+  }{
+    {"failing briefly", []string{"a", "b"}, time.Hour, []report{{"a", true}, {"a", true}}, "a"},
+    {"failing past after", []string{"a", "b"}, 0, []report{{"a", true}}, "b"},
+    {"success resets", []string{"a", "b"}, time.Hour, []report{{"a", true}, {"a", false}}, "a"},
+    {"late report from old endpoint", []string{"a", "b"}, 0, []report{{"a", true}, {"a", true}}, "b"},
+    {"wraps around", []string{"a", "b", "c"}, 0, []report{{"a", true}, {"b", true}, {"c", true}}, "a"},
+    {"single endpoint", []string{"a"}, 0, []report{{"a", true}, {"a", true}}, "a"},
+    {"trailing slash", []string{"a/", "b/"}, 0, []report{{"a", true}}, "b"},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      s := newEndpointSet(tt.bases)
+      for _, r := range tt.reports {
+        s.report(r.base, r.failed, tt.after)
+      }
+      if got := s.pick(time.Hour); got != tt.want {
+        t.Errorf("got %s, want %s", got, tt.want)
+      }
+    })
+  }
+}
+
+// The primary endpoint is tried again once failback has passed.
+func TestEndpointFailback(t *testing.T) {
+  s := newEndpointSet([]string{"a", "b"})
+  s.report("a", true, 0)
+
+  if got := s.pick(20*time.Millisecond); got != "b" {
+    t.Fatalf("got %s right after failing over, want b", got)
+  }
+  time.Sleep(30*time.Millisecond)
+  if got := s.pick(20*time.Millisecond); got != "a" {
+    t.Errorf("got %s after failback, want a", got)
+  }
+  if got := s.pick(0); got != "a" {
+    t.Errorf("got %s, want to stay on a", got)
+  }
+
+  // without a failback the fallback is kept
+  s.report("a", true, 0)
+  time.Sleep(30*time.Millisecond)
+  if got := s.pick(0); got != "b" {
+    t.Errorf("got %s with no failback, want b", got)
+  }
+}
+
+// A retry after the primary fails is sent to the fallback.
+func TestHandlerFailover(t *testing.T) {
+  var primary, fallback atomic.Int32
+  down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    primary.Add(1)
+    w.WriteHeader(http.StatusBadGateway)
+  }))
+  defer down.Close()
+
+  up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fallback.Add(1)
+    w.Write([]byte(agencyListJSON))
+  }))
+  defer up.Close()
+
+  h := NewApiHandler(&GetConfig{Timeout: 5*time.Second},
+    WithBaseURL(down.URL, up.URL),
+    WithFailover(0, time.Hour),
+    WithRetryPolicy(&BackoffPolicy{MaxRetries: 1, InitialDelay: time.Millisecond}),
+    WithoutRateLimit(),
+  )
+
+  resp := h.Get(MethodAgencyList())
+  if resp.Error() != nil {
+    t.Fatal(resp.Error())
+  }
+  if primary.Load() != 1 || fallback.Load() != 1 {
+    t.Errorf("got %d primary and %d fallback requests, want 1 each", primary.Load(), fallback.Load())
+  }
+  if h.CurrentEndpoint() != up.URL {
+    t.Errorf("got endpoint %s, want the fallback %s", h.CurrentEndpoint(), up.URL)
+  }
+}
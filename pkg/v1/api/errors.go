@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bytes of an error response body kept on HTTPStatusError
+const maxErrorBodySize int = 512
+
+// TransportError is returned when a request could not be sent, or its
+// response could not be read, eg a refused connection or a timeout.
+type TransportError struct {
+  Command string
+  Err     error
+}
+
+func (e *TransportError) Error() string {
+  return fmt.Sprintf("umoiq transport error for command %s: %s", e.Command, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+  return e.Err
+}
+
+// HTTPStatusError is returned when the feed answers with a non-2xx
+// status, such as a 503 error page or a 429.
+type HTTPStatusError struct {
+  StatusCode int
+  Status     string
+  Command    string
+  // The start of the response body, truncated to 512 bytes
+  Body       []byte
+  // Parsed from the Retry-After header, zero if it was not sent
+  RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+  return fmt.Sprintf("umoiq http error for command %s: %s", e.Command, e.Status)
+}
+
+// DecodeError is returned when a response body could not be decoded by
+// the handler's backend.
+type DecodeError struct {
+  Command string
+  Err     error
+}
+
+func (e *DecodeError) Error() string {
+  return fmt.Sprintf("umoiq decode error for command %s: %s", e.Command, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+  return e.Err
+}
+
+// ResponseTooLargeError is returned when a response body exceeds the
+// handler's maximum response size.
+type ResponseTooLargeError struct {
+  Command string
+  Limit   int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+  return fmt.Sprintf("umoiq response for command %s exceeds %d bytes", e.Command, e.Limit)
+}
+
+// parses a Retry-After header, given either as seconds or an HTTP date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+  if v == "" {
+    return 0
+  }
+
+  secs, err := strconv.Atoi(v)
+  if err == nil {
+    if secs < 0 {
+      return 0
+    }
+    return time.Duration(secs)*time.Second
+  }
+
+  t, err := http.ParseTime(v)
+  if err != nil || !t.After(now) {
+    return 0
+  }
+
+  return t.Sub(now)
+}
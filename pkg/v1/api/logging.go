@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Sets the logger that records every feed request. Attempts and cache
+// decisions are logged at debug level, failed attempts at warn, and
+// requests that fail after all retries at error. Without a logger
+// nothing is logged.
+func WithLogger(l *slog.Logger) ApiOption {
+  return func(a *ApiHandler) {
+    a.logger = l
+  }
+}
+
+func (a *ApiHandler) logEnabled(ctx context.Context, level slog.Level) bool {
+  return a.logger != nil && a.logger.Enabled(ctx, level)
+}
+
+// attributes describing what a method asks the feed for
+func methodAttrs(m ApiMethod) []slog.Attr {
+  attrs := []slog.Attr{slog.String("command", m.Command)}
+
+  fields := []struct{ key, param string }{
+    {"agency", "a"},
+    {"route", "r"},
+    {"route", "routeTag"},
+    {"stop", "stopId"},
+    {"stop", "s"},
+    {"vehicle", "v"},
+  }
+  for _, f := range fields {
+    v := m.Get(f.param)
+    if v != "" {
+      attrs = append(attrs, slog.String(f.key, v))
+    }
+  }
+
+  return attrs
+}
+
+// attributes describing the outcome of a response
+func responseAttrs(resp *ApiResponse) []slog.Attr {
+  attrs := []slog.Attr{slog.Int("bytes", len(resp.Data))}
+  if resp.Response != nil {
+    attrs = append(attrs, slog.Int("status", resp.Response.StatusCode))
+  }
+  if resp.Error() != nil {
+    attrs = append(attrs, slog.String("error", resp.Error().Error()))
+  }
+
+  return attrs
+}
+
+func (a *ApiHandler) logAttempt(ctx context.Context, m ApiMethod, attempt int, endpoint string, latency time.Duration, resp *ApiResponse) {
+  level := slog.LevelDebug
+  if resp.Error() != nil {
+    level = slog.LevelWarn
+  }
+  if !a.logEnabled(ctx, level) {
+    return
+  }
+
+  attrs := methodAttrs(m)
+  attrs = append(attrs,
+    slog.Int("attempt", attempt),
+    slog.String("endpoint", endpoint),
+    slog.Duration("latency", latency),
+  )
+  attrs = append(attrs, responseAttrs(resp)...)
+  a.logger.LogAttrs(ctx, level, "umoiq feed attempt", attrs...)
+}
+
+func (a *ApiHandler) logRequest(ctx context.Context, m ApiMethod, attempts int, elapsed time.Duration, resp *ApiResponse) {
+  level := slog.LevelDebug
+  if resp.Error() != nil {
+    level = slog.LevelError
+  }
+  if !a.logEnabled(ctx, level) {
+    return
+  }
+
+  attrs := methodAttrs(m)
+  attrs = append(attrs,
+    slog.Int("attempts", attempts),
+    slog.Duration("latency", elapsed),
+  )
+  attrs = append(attrs, responseAttrs(resp)...)
+  a.logger.LogAttrs(ctx, level, "umoiq feed request", attrs...)
+}
+
+func (a *ApiHandler) logCoalesced(ctx context.Context, m ApiMethod) {
+  if !a.logEnabled(ctx, slog.LevelDebug) {
+    return
+  }
+
+  a.logger.LogAttrs(ctx, slog.LevelDebug, "umoiq feed request coalesced", methodAttrs(m)...)
+}
+
+// records whether a cached layer (eg "routes") answered a call
+func (a *ApiHandler) logCache(ctx context.Context, layer string, hit bool, attrs ...slog.Attr) {
+  if !a.logEnabled(ctx, slog.LevelDebug) {
+    return
+  }
+
+  cache := "miss"
+  if hit {
+    cache = "hit"
+  }
+
+  attrs = append([]slog.Attr{slog.String("layer", layer), slog.String("cache", cache)}, attrs...)
+  a.logger.LogAttrs(ctx, slog.LevelDebug, "umoiq cache lookup", attrs...)
+}
+
+// warns of an agency whose times will be given in the local time zone
+func (a *ApiHandler) logUnknownZone(ctx context.Context, agency, region string) {
+  if !a.logEnabled(ctx, slog.LevelWarn) {
+    return
+  }
+
+  a.logger.LogAttrs(ctx, slog.LevelWarn, "umoiq agency time zone unknown",
+    slog.String("agency", agency),
+    slog.String("region", region),
+    slog.String("using", time.Local.String()),
+  )
+}
+
+// summarises an Agency.GetRoutes call, which fans out into a routeConfig
+// request for every route of the agency
+func (a *ApiHandler) logRoutesSpan(ctx context.Context, agency string, routes int, elapsed time.Duration, err error) {
+  level := slog.LevelInfo
+  if err != nil {
+    level = slog.LevelError
+  }
+  if !a.logEnabled(ctx, level) {
+    return
+  }
+
+  attrs := []slog.Attr{
+    slog.String("agency", agency),
+    slog.Int("routes", routes),
+    slog.Duration("latency", elapsed),
+  }
+  if err != nil {
+    attrs = append(attrs, slog.String("error", err.Error()))
+  }
+  a.logger.LogAttrs(ctx, level, "umoiq routes loaded", attrs...)
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/internal/utils"
+)
+
+// Message is a service alert published by an agency, eg a detour or a
+// stop closure.
+type Message struct {
+  ID          string
+  // As given by the agency, eg "Low", "Normal", "High" or "Critical"
+  Priority    string
+  Text        string
+  // Shortened text for SMS, empty if the agency gave none
+  SmsText     string
+  // Text spelled out for text-to-speech, empty if the agency gave none
+  PhonemeText string
+  // Signals that the message is also shown on vehicle displays
+  SendToBuses bool
+  // The message is only shown between Start and End, either may be
+  // zero if it is unbounded
+  Start       time.Time
+  End         time.Time
+  // Weekly windows in which the message is shown, the message is shown
+  // at any time if there are none
+  Intervals   []*MessageInterval
+  // Tags of the routes the message was published for, empty if the
+  // message applies to the whole agency
+  Routes      []string
+  // Narrows the message down to particular stops or directions of its
+  // routes. A route without a scope is covered as a whole.
+  Scopes      []*MessageScope
+  // the agency's location, which intervals are given in
+  location    *time.Location
+}
+
+// MessageScope limits a message to some stops or directions of a route.
+type MessageScope struct {
+  Route      string
+  // Stop tags
+  Stops      []string
+  // Direction (Service) tags
+  Directions []string
+}
+
+// MessageInterval is a weekly recurring window in which a message is
+// shown. Days count from Sunday (0), times are seconds past midnight.
+type MessageInterval struct {
+  StartDay  int
+  StartTime int
+  EndDay    int
+  EndTime   int
+}
+
+const secondsPerDay int = 24*60*60
+
+// Contains reports whether t falls inside the interval, using the
+// weekday and time of day of t in its own location. Intervals may wrap
+// around the end of the week.
+func (i *MessageInterval) Contains(t time.Time) bool {
+  now := int(t.Weekday())*secondsPerDay + t.Hour()*3600 + t.Minute()*60 + t.Second()
+  start := i.StartDay*secondsPerDay + i.StartTime
+  end := i.EndDay*secondsPerDay + i.EndTime
+
+  if start <= end {
+    return now >= start && now < end
+  }
+
+  return now >= start || now < end
+}
+
+// AgencyWide reports whether the message applies to every route.
+func (m *Message) AgencyWide() bool {
+  return len(m.Routes) == 0
+}
+
+// ActiveAt reports whether the message is shown at t, that is t falls
+// between its boundaries and inside one of its intervals. Intervals are
+// checked against the agency's local time.
+func (m *Message) ActiveAt(t time.Time) bool {
+  if m.location != nil {
+    t = t.In(m.location)
+  }
+
+  if !m.Start.IsZero() && t.Before(m.Start) {
+    return false
+  }
+
+  if !m.End.IsZero() && !t.Before(m.End) {
+    return false
+  }
+
+  if len(m.Intervals) == 0 {
+    return true
+  }
+
+  for _, i := range m.Intervals {
+    if i.Contains(t) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// AppliesTo reports whether the message covers stop s on route r. If s
+// is nil only the route is checked.
+func (m *Message) AppliesTo(r *Route, s *Stop) bool {
+  if m.AgencyWide() {
+    return true
+  }
+
+  if !slices.Contains(m.Routes, r.Tag) {
+    return false
+  }
+
+  if s == nil {
+    return true
+  }
+
+  scoped := false
+  for _, sc := range m.Scopes {
+    if sc.Route != r.Tag {
+      continue
+    }
+    scoped = true
+
+    if slices.Contains(sc.Stops, s.Tag) {
+      return true
+    }
+
+    for _, d := range sc.Directions {
+      svc, err := r.GetService(d)
+      if err != nil {
+        continue
+      }
+      for _, stop := range svc.Stops {
+        if stop.Tag == s.Tag {
+          return true
+        }
+      }
+    }
+  }
+
+  return !scoped
+}
+
+// GetMessages fetches the messages for the given routes, along with
+// those for the whole agency. Without routes, the messages of every
+// route are returned.
+func (a *Agency) GetMessages(routeTags ...string) ([]*Message, error) {
+  return a.GetMessagesContext(a.api.context(), routeTags...)
+}
+
+func (a *Agency) GetMessagesContext(ctx context.Context, routeTags ...string) ([]*Message, error) {
+  return a.GetMessagesWithOptionsContext(ctx, routeTags)
+}
+
+// GetMessagesWithOptions is GetMessages with ApiHandlerOptions. With no
+// routes (nil), the messages of every route are returned.
+func (a *Agency) GetMessagesWithOptions(routeTags []string, opts...ApiHandlerOption) ([]*Message, error) {
+  return a.GetMessagesWithOptionsContext(a.api.contextFor(opts), routeTags, opts...)
+}
+
+func (a *Agency) GetMessagesWithOptionsContext(ctx context.Context, routeTags []string, opts...ApiHandlerOption) ([]*Message, error) {
+  aho := *DefaultApiHandlerOptions
+  for _, opt := range opts {
+    opt(&aho)
+  }
+
+  iface, err := a.api.fetch(ctx, MethodMessages(a.Tag, routeTags...), PriorityInteractive, aho.GetOpts...)
+  if err != nil {
+    return nil, err
+  }
+
+  return unmarshalMessages(iface, a.location())
+}
+
+// GetMessages fetches the messages that apply to the stop on any of the
+// routes serving it.
+func (s *Stop) GetMessages(opts...ApiHandlerOption) ([]*Message, error) {
+  return s.GetMessagesContext(s.api.contextFor(opts), opts...)
+}
+
+func (s *Stop) GetMessagesContext(ctx context.Context, opts...ApiHandlerOption) ([]*Message, error) {
+  aho := *DefaultApiHandlerOptions
+  for _, opt := range opts {
+    opt(&aho)
+  }
+
+  routes, err := s.agency.GetRoutesContext(ctx, WithGetOpts(aho.GetOpts...))
+  if err != nil {
+    return nil, err
+  }
+
+  serving := make([]*Route, 0)
+  tags := make([]string, 0)
+  for _, r := range routes {
+    _, err := r.GetStopByTag(s.Tag)
+    if err == nil {
+      serving = append(serving, r)
+      tags = append(tags, r.Tag)
+    }
+  }
+
+  if len(serving) == 0 {
+    return nil, errors.New("StopNotFoundErr")
+  }
+
+  msgs, err := s.agency.GetMessagesWithOptionsContext(ctx, tags, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  out := make([]*Message, 0)
+  for _, m := range msgs {
+    for _, r := range serving {
+      if m.AppliesTo(r, s) {
+        out = append(out, m)
+        break
+      }
+    }
+  }
+
+  return out, nil
+}
+
+// Messages are grouped under route elements, agency-wide ones under the
+// tag "all". A message published for several routes is listed under
+// each of them, and is returned once.
+func unmarshalMessages(iface map[string]interface{}, loc *time.Location) ([]*Message, error) {
+  routes, ok := utils.IfaceToSlice(iface["route"])
+  if !ok {
+    // no messages at all
+    return []*Message{}, nil
+  }
+
+  msgs := make([]*Message, 0)
+  byID := make(map[string]*Message)
+  for _, routeProto := range routes {
+    route, ok := routeProto.(map[string]interface{})
+    if !ok {
+      return nil, errors.New("Could not unmarshal message route to map[string]interface{}")
+    }
+
+    routeTag, _ := utils.IfaceToString(route["tag"])
+    msgList, _ := utils.IfaceToSlice(route["message"])
+    for _, msgProto := range msgList {
+      m, err := unmarshalMessage(msgProto, loc)
+      if err != nil {
+        return nil, err
+      }
+
+      seen, ok := byID[m.ID]
+      if ok && m.ID != "" {
+        m = seen
+      } else {
+        byID[m.ID] = m
+        msgs = append(msgs, m)
+      }
+
+      if routeTag != "all" && routeTag != "" && !slices.Contains(m.Routes, routeTag) {
+        m.Routes = append(m.Routes, routeTag)
+      }
+    }
+  }
+
+  return msgs, nil
+}
+
+func unmarshalMessage(v interface{}, loc *time.Location) (*Message, error) {
+  msg, ok := v.(map[string]interface{})
+  if !ok {
+    return nil, errors.New("Could not unmarshal message to map[string]interface{}")
+  }
+
+  m := &Message{
+    location: loc,
+  }
+
+  id, ok := utils.IfaceToString(msg["id"])
+  if ok {
+    m.ID = id
+  }
+
+  priority, ok := utils.IfaceToString(msg["priority"])
+  if ok {
+    m.Priority = priority
+  }
+
+  text, ok := utils.IfaceToText(msg["text"])
+  if !ok {
+    return nil, errors.New("Could not get text of message "+id)
+  }
+  m.Text = text
+
+  sms, ok := utils.IfaceToText(msg["smsText"])
+  if ok {
+    m.SmsText = sms
+  }
+
+  phoneme, ok := utils.IfaceToText(msg["phonemeText"])
+  if ok {
+    m.PhonemeText = phoneme
+  }
+
+  stb, ok := utils.IfaceToBool(msg["sendToBuses"])
+  if ok {
+    m.SendToBuses = stb
+  }
+
+  start, ok := utils.IfaceToInt(msg["startBoundary"])
+  if ok {
+    m.Start = time.UnixMilli(int64(start)).In(loc)
+  }
+
+  end, ok := utils.IfaceToInt(msg["endBoundary"])
+  if ok {
+    m.End = time.UnixMilli(int64(end)).In(loc)
+  }
+
+  intervals, _ := utils.IfaceToSlice(msg["interval"])
+  for _, intervalProto := range intervals {
+    interval, ok := intervalProto.(map[string]interface{})
+    if !ok {
+      continue
+    }
+
+    i := &MessageInterval{}
+    i.StartDay, _ = utils.IfaceToInt(interval["startDay"])
+    i.StartTime, _ = utils.IfaceToInt(interval["startTime"])
+    i.EndDay, _ = utils.IfaceToInt(interval["endDay"])
+    i.EndTime, _ = utils.IfaceToInt(interval["endTime"])
+    m.Intervals = append(m.Intervals, i)
+  }
+
+  scopes, _ := utils.IfaceToSlice(msg["routeConfiguredForMessage"])
+  for _, scopeProto := range scopes {
+    scope, ok := scopeProto.(map[string]interface{})
+    if !ok {
+      continue
+    }
+
+    sc := &MessageScope{}
+    sc.Route, _ = utils.IfaceToString(scope["tag"])
+    sc.Stops = elementTags(scope["stop"])
+    sc.Directions = elementTags(scope["direction"])
+    m.Scopes = append(m.Scopes, sc)
+  }
+
+  return m, nil
+}
+
+// the tags of a list of elements, eg the stops of a message scope
+func elementTags(v interface{}) []string {
+  tags := make([]string, 0)
+  list, _ := utils.IfaceToSlice(v)
+  for _, proto := range list {
+    el, ok := proto.(map[string]interface{})
+    if !ok {
+      continue
+    }
+
+    tag, ok := utils.IfaceToString(el["tag"])
+    if ok {
+      tags = append(tags, tag)
+    }
+  }
+
+  return tags
+}
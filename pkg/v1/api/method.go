@@ -0,0 +1,166 @@
+package api
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ApiMethod is a feed command and its parameters. Parameters keep the
+// order they were added in, and may repeat, eg the stops of
+// predictionsForMultiStops. Use the Method constructors, or
+// NewApiMethod for commands they don't cover.
+//
+// ApiMethod can't be compared with ==, compare Key()s instead.
+type ApiMethod struct {
+  // The feed command, eg "routeConfig"
+  Command string
+  // in the order they were added, never modified in place so that
+  // copies of a method don't share changes
+  params  []methodParam
+}
+
+type methodParam struct {
+  key   string
+  value string
+}
+
+// NewApiMethod builds a method for command from key/value pairs, eg
+// NewApiMethod("routeConfig", "a", "sf-muni", "r", "N").
+func NewApiMethod(command string, kv ...string) ApiMethod {
+  m := ApiMethod{
+    Command: command,
+    params: make([]methodParam, 0, (len(kv)+1)/2),
+  }
+
+  for i := 0; i < len(kv); i += 2 {
+    v := ""
+    if i+1 < len(kv) {
+      v = kv[i+1]
+    }
+    m.params = append(m.params, methodParam{kv[i], v})
+  }
+
+  return m
+}
+
+// With returns a copy of m with the parameter key=value added after the
+// others.
+func (m ApiMethod) With(key, value string) ApiMethod {
+  params := append(m.params[:len(m.params):len(m.params)], methodParam{key, value})
+  return ApiMethod{Command: m.Command, params: params}
+}
+
+// Get returns the first value of the parameter key, or "" if unset.
+func (m ApiMethod) Get(key string) string {
+  for _, p := range m.params {
+    if p.key == key {
+      return p.value
+    }
+  }
+
+  return ""
+}
+
+// Values returns the full query of the method, command included.
+// Repeated parameters keep their order.
+func (m ApiMethod) Values() url.Values {
+  q := make(url.Values, len(m.params)+1)
+  q.Set("command", m.Command)
+  for _, p := range m.params {
+    q.Add(p.key, p.value)
+  }
+
+  return q
+}
+
+// Key returns the canonical, URL-encoded form of the method, with
+// parameter names sorted. Repeated values of a parameter keep the order
+// they were added in, since it can matter to the feed, eg the stops of
+// predictionsForMultiStops. Otherwise methods asking for the same thing
+// have the same key, so it can be used to compare methods or as a cache
+// key. The key of a request in package replay is the feed path, "?" and
+// this key, eg "publicJSONFeed?"+m.Key().
+func (m ApiMethod) Key() string {
+  return m.Values().Encode()
+}
+
+// Query returns the query string the method is requested with,
+// including the leading "?". Unlike Key, parameters are in the order
+// they were added, after the command.
+func (m ApiMethod) Query() string {
+  var b strings.Builder
+  b.WriteString("?command=")
+  b.WriteString(url.QueryEscape(m.Command))
+  for _, p := range m.params {
+    b.WriteByte('&')
+    b.WriteString(url.QueryEscape(p.key))
+    b.WriteByte('=')
+    b.WriteString(url.QueryEscape(p.value))
+  }
+
+  return b.String()
+}
+
+func (m ApiMethod) String() string {
+  return m.Key()
+}
+
+func MethodRoutes(agency string) ApiMethod {
+  return NewApiMethod("routeList", "a", agency)
+}
+
+func MethodRouteConfig(agency, route string) ApiMethod {
+  return NewApiMethod("routeConfig", "a", agency, "r", route, "verbose", "")
+}
+
+func MethodAgencyList() ApiMethod {
+  return NewApiMethod("agencyList")
+}
+
+func MethodSchedule(agency, route string) ApiMethod {
+  return NewApiMethod("schedule", "a", agency, "r", route)
+}
+
+// time is the epoch time in milliseconds of the last poll, only
+// vehicles that have reported since are returned. Use "0" for every
+// vehicle. Without a route, the vehicles of every route are returned.
+func MethodVehicleLocations(agency, route, time string) ApiMethod {
+  m := NewApiMethod("vehicleLocations", "a", agency)
+  if route != "" {
+    m = m.With("r", route)
+  }
+  if time == "" {
+    time = "0"
+  }
+
+  return m.With("t", time)
+}
+
+func MethodVehicleLocation(agency, vehicleId string) ApiMethod {
+  return NewApiMethod("vehicleLocation", "a", agency, "v", vehicleId)
+}
+
+func MethodPredictions(agency, stopId, route string) ApiMethod {
+  m := NewApiMethod("predictions", "a", agency, "stopId", stopId)
+  if route != "" {
+    m = m.With("routeTag", route)
+  }
+
+  return m
+}
+
+// Addresses the stop by route and stop tag, for stops without a public
+// stopId.
+func MethodPredictionsByTag(agency, route, stopTag string) ApiMethod {
+  return NewApiMethod("predictions", "a", agency, "r", route, "s", stopTag)
+}
+
+// Without routes the feed returns the messages of every route.
+func MethodMessages(agency string, routes ...string) ApiMethod {
+  m := NewApiMethod("messages", "a", agency)
+  for _, r := range routes {
+    m = m.With("r", r)
+  }
+
+  return m
+}
@@ -0,0 +1,53 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+)
+
+func TestApiMethodOrder(t *testing.T) {
+  m := api.MethodPredictionsForMultiStops("sf-muni",
+    api.RouteStop{Route: "N", Stop: "5240"},
+    api.RouteStop{Route: "J", Stop: "4006"},
+    api.RouteStop{Route: "F", Stop: "1 & 2"},
+  )
+
+  want := "?command=predictionsForMultiStops&a=sf-muni&stops=N%7C5240&stops=J%7C4006&stops=F%7C1+%26+2"
+  if m.Query() != want {
+    t.Errorf("got query %s, want %s", m.Query(), want)
+  }
+
+  want = "a=sf-muni&command=predictionsForMultiStops&stops=N%7C5240&stops=J%7C4006&stops=F%7C1+%26+2"
+  if m.Key() != want {
+    t.Errorf("got key %s, want %s", m.Key(), want)
+  }
+}
+
+func TestApiMethodKey(t *testing.T) {
+  a := api.NewApiMethod("schedule", "a", "sf-muni", "r", "N")
+  b := api.NewApiMethod("schedule", "r", "N", "a", "sf-muni")
+  if a.Key() != b.Key() {
+    t.Errorf("keys differ: %s and %s", a.Key(), b.Key())
+  }
+  if a.Query() == b.Query() {
+    t.Errorf("queries don't keep parameter order: %s", a.Query())
+  }
+}
+
+func TestApiMethodWithCopies(t *testing.T) {
+  base := api.NewApiMethod("messages", "a", "sf-muni")
+  n := base.With("r", "N")
+  j := base.With("r", "J")
+  nj := n.With("r", "J")
+
+  if base.Get("r") != "" {
+    t.Errorf("With changed the original: %s", base)
+  }
+  if n.Get("r") != "N" || j.Get("r") != "J" {
+    t.Errorf("copies share parameters: %s and %s", n, j)
+  }
+  if got := nj.Values()["r"]; len(got) != 2 || got[0] != "N" || got[1] != "J" {
+    t.Errorf("got r=%v, want [N J]", got)
+  }
+}
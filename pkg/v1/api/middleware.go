@@ -0,0 +1,189 @@
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestHandler performs the feed request for a resolved ApiMethod.
+type RequestHandler func(m ApiMethod, req *http.Request) *ApiResponse
+
+// Middleware wraps the handler that performs a request. A middleware
+// may change the request before passing it to next, inspect or replace
+// the response next returns, or short-circuit the call by returning a
+// response of its own without calling next.
+type Middleware func(next RequestHandler) RequestHandler
+
+// Adds middlewares to the handler's chain. The first middleware given
+// is the outermost, seeing the request first and the response last.
+// User middlewares always run outside the built-in header and client
+// layers.
+func WithMiddleware(mw ...Middleware) ApiOption {
+  return func(a *ApiHandler) {
+    a.middleware = append(a.middleware, mw...)
+  }
+}
+
+// NewApiResponse builds a response, for middlewares that answer a
+// request themselves rather than calling the next handler.
+func NewApiResponse(resp *http.Response, data []byte, err error) *ApiResponse {
+  return &ApiResponse{
+    Response: resp,
+    Data: data,
+    err: err,
+  }
+}
+
+// HeaderMiddleware sets the given headers on every request.
+func HeaderMiddleware(headers map[string]string) Middleware {
+  return func(next RequestHandler) RequestHandler {
+    return func(m ApiMethod, req *http.Request) *ApiResponse {
+      for k, v := range headers {
+        req.Header.Set(k, v)
+      }
+
+      return next(m, req)
+    }
+  }
+}
+
+// ClientMiddleware sends requests with c and reads the response body.
+// Gzip is negotiated explicitly and decompressed as the body is read,
+// and bodies larger than maxSize bytes once decompressed fail with a
+// ResponseTooLargeError, 0 for no limit. Failures are returned as a
+// TransportError, and non-2xx statuses as an HTTPStatusError. It never
+// calls next, so it ends the chain; every handler's chain ends with the
+// client set by WithHttpClient.
+func ClientMiddleware(c *http.Client, maxSize int64) Middleware {
+  return func(next RequestHandler) RequestHandler {
+    return func(m ApiMethod, req *http.Request) *ApiResponse {
+      // setting this ourselves turns off the transport's transparent
+      // decompression, so that we can count the bytes on the wire
+      req.Header.Set("Accept-Encoding", "gzip")
+
+      apiResp := &ApiResponse{}
+      resp, err := c.Do(req)
+      apiResp.Response = resp
+      if err != nil {
+        apiResp.err = &TransportError{Command: m.Command, Err: err}
+        return apiResp
+      }
+
+      wire := &countingReader{r: resp.Body}
+      // drain whatever is left so the connection can be reused
+      defer func() {
+        io.Copy(io.Discard, io.LimitReader(wire, 64*1024))
+        resp.Body.Close()
+        apiResp.CompressedSize = wire.n
+      }()
+
+      var body io.Reader = wire
+      if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+        zr, err := gzip.NewReader(wire)
+        if err != nil {
+          apiResp.err = &TransportError{Command: m.Command, Err: err}
+          return apiResp
+        }
+        defer zr.Close()
+        body = zr
+      }
+
+      if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        data, _ := io.ReadAll(io.LimitReader(body, int64(maxErrorBodySize)))
+        apiResp.err = &HTTPStatusError{
+          StatusCode: resp.StatusCode,
+          Status: resp.Status,
+          Command: m.Command,
+          Body: data,
+          RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+        }
+        return apiResp
+      }
+
+      if maxSize > 0 {
+        if body == io.Reader(wire) && resp.ContentLength > maxSize {
+          apiResp.err = &ResponseTooLargeError{Command: m.Command, Limit: maxSize}
+          return apiResp
+        }
+        body = io.LimitReader(body, maxSize+1)
+      }
+
+      data, err := io.ReadAll(body)
+      if err != nil {
+        apiResp.err = &TransportError{Command: m.Command, Err: err}
+        return apiResp
+      }
+
+      if maxSize > 0 && int64(len(data)) > maxSize {
+        apiResp.err = &ResponseTooLargeError{Command: m.Command, Limit: maxSize}
+        return apiResp
+      }
+
+      apiResp.Data = data
+      apiResp.UncompressedSize = int64(len(data))
+      return apiResp
+    }
+  }
+}
+
+// counts the bytes read through it
+type countingReader struct {
+  r io.Reader
+  n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+  n, err := c.r.Read(p)
+  c.n += int64(n)
+  return n, err
+}
+
+// decodes successful responses with the handler's backend so that the
+// feed's error envelope is reported as a FeedError to every layer above
+func (a *ApiHandler) decodeMiddleware() Middleware {
+  return func(next RequestHandler) RequestHandler {
+    return func(m ApiMethod, req *http.Request) *ApiResponse {
+      resp := next(m, req)
+      if resp.err != nil {
+        return resp
+      }
+
+      body, err := a.decode(m, resp)
+      if err != nil {
+        resp.err = err
+        return resp
+      }
+
+      ferr := unmarshalFeedError(m, body)
+      if ferr != nil {
+        resp.err = ferr
+      }
+
+      return resp
+    }
+  }
+}
+
+// the end of every chain, only reached if a client middleware is missing
+func noTransport(m ApiMethod, req *http.Request) *ApiResponse {
+  return &ApiResponse{err: errors.New("NoTransportErr")}
+}
+
+// builds the chain for a request: user middlewares, then the built-in
+// header, decoding and client layers
+func (a *ApiHandler) chain(headers map[string]string) RequestHandler {
+  layers := make([]Middleware, 0, len(a.middleware)+3)
+  layers = append(layers, a.middleware...)
+  layers = append(layers, HeaderMiddleware(headers), a.decodeMiddleware(), ClientMiddleware(a.c, a.maxResponseSize))
+
+  h := RequestHandler(noTransport)
+  for i := len(layers)-1; i >= 0; i-- {
+    h = layers[i](h)
+  }
+
+  return h
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/internal/utils"
+)
+
+// Most stops the feed accepts in one predictionsForMultiStops request
+const MaxStopsPerRequest int = 150
+// Longest request URL made for predictionsForMultiStops, kept well below
+// the limits of common proxies and servers
+const MaxRequestURLLength int = 2000
+
+// RouteStop addresses a stop by route tag and stop tag, which works for
+// stops that have no public stopId.
+type RouteStop struct {
+  Route string
+  Stop  string
+}
+
+func MethodPredictionsForMultiStops(agency string, stops ...RouteStop) ApiMethod {
+  m := NewApiMethod("predictionsForMultiStops", "a", agency)
+  for _, s := range stops {
+    m = m.With("stops", s.Route+"|"+s.Stop)
+  }
+
+  return m
+}
+
+// splits stops into as few requests as the feed's limits allow
+func multiStopBatches(agency, base string, stops []RouteStop) [][]RouteStop {
+  batches := make([][]RouteStop, 0)
+  batch := make([]RouteStop, 0)
+  for _, s := range stops {
+    next := append(batch[:len(batch):len(batch)], s)
+    m := MethodPredictionsForMultiStops(agency, next...)
+    if len(batch) > 0 && (len(next) > MaxStopsPerRequest || len(base)+len(m.Query()) > MaxRequestURLLength) {
+      batches = append(batches, batch)
+      next = []RouteStop{s}
+    }
+    batch = next
+  }
+
+  if len(batch) > 0 {
+    batches = append(batches, batch)
+  }
+
+  return batches
+}
+
+func (a *Agency) GetPredictionsForStops(stops []RouteStop, opts...ApiHandlerOption) (map[RouteStop][]*Prediction, error) {
+  return a.GetPredictionsForStopsContext(a.api.contextFor(opts), stops, opts...)
+}
+
+// GetPredictionsForStopsContext fetches predictions for many stops at
+// once with the predictionsForMultiStops command. Stops are split over
+// as many requests as the feed's limits need, which are made
+// concurrently. Every requested stop has an entry in the result, empty
+// if there are no predictions. The results also fill the prediction
+// cache of each Stop for its route, see WithCacheMaxAge.
+func (a *Agency) GetPredictionsForStopsContext(ctx context.Context, stops []RouteStop, opts...ApiHandlerOption) (map[RouteStop][]*Prediction, error) {
+  aho := &ApiHandlerOptions{
+    UseCache: true,
+  }
+
+  for _, opt := range opts {
+    opt(aho)
+  }
+
+  cacheMaxAge := time.Duration(aho.CacheMaxAge)*time.Second
+  now := time.Now()
+
+  // the routes are loaded once up front, the batches only make requests
+  // and the agency's route cache is not touched while they run
+  routes, err := a.GetRoutesContext(ctx, WithGetOpts(aho.GetOpts...))
+  if err != nil {
+    return nil, err
+  }
+
+  routeMap := make(map[string]*Route, len(routes))
+  for _, r := range routes {
+    routeMap[r.Tag] = r
+  }
+
+  results := make(map[RouteStop][]*Prediction, len(stops))
+  resolved := make(map[RouteStop]*Stop, len(stops))
+  pending := make([]RouteStop, 0, len(stops))
+  for _, rs := range stops {
+    _, dup := resolved[rs]
+    if dup {
+      continue
+    }
+
+    route, ok := routeMap[rs.Route]
+    if !ok {
+      return nil, errors.New("RouteNotFoundErr")
+    }
+    stop, err := route.GetStopByTag(rs.Stop)
+    if err != nil {
+      return nil, err
+    }
+    resolved[rs] = stop
+
+    preds, age := stop.cachedRoutePredictions(rs.Route)
+    hit := aho.UseCache && preds != nil && now.Sub(age) <= cacheMaxAge
+    a.api.cacheLookup(ctx, "predictions", hit, slog.String("agency", a.Tag), slog.String("route", rs.Route), slog.String("stop", rs.Stop))
+    if hit {
+      results[rs] = preds
+      continue
+    }
+
+    results[rs] = []*Prediction{}
+    pending = append(pending, rs)
+  }
+
+  if len(pending) == 0 {
+    return results, nil
+  }
+
+  base := a.api.CurrentEndpoint()+"/"+a.api.backend.FeedPath()
+  batches := multiStopBatches(a.Tag, base, pending)
+
+  var mu sync.Mutex
+  var wg sync.WaitGroup
+  errs := make([]error, 0)
+  responses := make([]map[string]interface{}, len(batches))
+  for i, batch := range batches {
+    wg.Add(1)
+    go func(i int, batch []RouteStop) {
+      defer wg.Done()
+
+      iface, err := a.api.fetch(ctx, MethodPredictionsForMultiStops(a.Tag, batch...), PriorityInteractive, aho.GetOpts...)
+      if err != nil {
+        mu.Lock()
+        errs = append(errs, err)
+        mu.Unlock()
+        return
+      }
+      responses[i] = iface
+    }(i, batch)
+  }
+  wg.Wait()
+
+  if len(errs) > 0 {
+    return nil, errors.Join(errs...)
+  }
+
+  for _, iface := range responses {
+    preds, err := a.unmarshalMultiStops(ctx, iface, resolved, routeMap)
+    if err != nil {
+      return nil, err
+    }
+    for rs, p := range preds {
+      results[rs] = p
+    }
+  }
+
+  for _, rs := range pending {
+    resolved[rs].cacheRoutePredictions(rs.Route, results[rs], now)
+  }
+
+  return results, nil
+}
+
+// unmarshals one predictionsForMultiStops response, keeping the stops
+// that were asked for
+func (a *Agency) unmarshalMultiStops(ctx context.Context, iface map[string]interface{}, stops map[RouteStop]*Stop, routes map[string]*Route) (map[RouteStop][]*Prediction, error) {
+  list, ok := utils.IfaceToSlice(iface["predictions"])
+  if !ok {
+    return nil, errors.New("PredictionUnmarshalErr")
+  }
+
+  results := make(map[RouteStop][]*Prediction)
+  for _, proto := range list {
+    rp, ok := proto.(map[string]interface{})
+    if !ok {
+      return nil, errors.New("RoutePredictionUnmarshalErr")
+    }
+
+    rs := RouteStop{}
+    rs.Route, _ = utils.IfaceToString(rp["routeTag"])
+    rs.Stop, _ = utils.IfaceToString(rp["stopTag"])
+    stop, ok := stops[rs]
+    if !ok {
+      continue
+    }
+
+    routePreds, err := unmarshalRoutePredictions(ctx, rp, stop, routes[rs.Route])
+    if err != nil {
+      return nil, err
+    }
+
+    results[rs] = routePreds.Predictions
+  }
+
+  return results, nil
+}
+
+// the cached predictions of one route at the stop, nil if there are none
+func (s *Stop) cachedRoutePredictions(routeTag string) ([]*Prediction, time.Time) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  preds, ok := s.predictionMap[routeTag]
+  if !ok {
+    return nil, time.Time{}
+  }
+
+  return preds, s.predictionAge[routeTag]
+}
+
+func (s *Stop) cacheRoutePredictions(routeTag string, preds []*Prediction, at time.Time) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if s.predictionMap == nil {
+    s.predictionMap = make(map[string][]*Prediction)
+    s.predictionAge = make(map[string]time.Time)
+  }
+
+  s.predictionMap[routeTag] = preds
+  s.predictionAge[routeTag] = at
+}
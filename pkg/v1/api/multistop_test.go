@@ -0,0 +1,92 @@
+package api_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+)
+
+// a route with n stops, each with a prediction
+func multiStopFeed(n int) *apitest.Feed {
+  route := &apitest.Route{
+    Tag: "N",
+    Title: "N-Judah",
+  }
+  dir := &apitest.Direction{
+    Tag: "N_O",
+    Title: "Outbound to Ocean Beach",
+    UseForUI: true,
+  }
+  route.Directions = []*apitest.Direction{dir}
+
+  agency := &apitest.Agency{
+    Tag: "sf-muni",
+    Title: "San Francisco Muni",
+    Routes: []*apitest.Route{route},
+  }
+
+  for i := 0; i < n; i++ {
+    tag := fmt.Sprintf("s%d", i)
+    route.Stops = append(route.Stops, &apitest.Stop{Tag: tag, StopID: fmt.Sprintf("%d", 10000+i), Title: "Stop "+tag})
+    dir.Stops = append(dir.Stops, tag)
+    agency.Predictions = append(agency.Predictions, &apitest.Prediction{
+      Route: "N",
+      Direction: "N_O",
+      Stop: tag,
+      Seconds: int64(60+i),
+      Vehicle: "1500",
+    })
+  }
+
+  return &apitest.Feed{Agencies: []*apitest.Agency{agency}}
+}
+
+// More stops than fit in one request are split over concurrent batches,
+// run with -race with the route cache expiring on every lookup.
+func TestGetPredictionsForStopsBatches(t *testing.T) {
+  srv := apitest.NewServer(multiStopFeed(api.MaxStopsPerRequest+30))
+  defer srv.Close()
+
+  for _, b := range []api.Backend{api.JSONBackend, api.XMLBackend} {
+    t.Run(b.FeedPath(), func(t *testing.T) {
+      h := srv.ApiHandler(api.WithBackend(b), api.WithMaxCacheAge(0))
+      agency, err := h.GetAgency("sf-muni")
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      stops := make([]api.RouteStop, 0)
+      for i := 0; i < api.MaxStopsPerRequest+30; i++ {
+        stops = append(stops, api.RouteStop{Route: "N", Stop: fmt.Sprintf("s%d", i)})
+      }
+
+      before := srv.Requests("predictionsForMultiStops")
+      results, err := agency.GetPredictionsForStops(stops)
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      made := srv.Requests("predictionsForMultiStops") - before
+      if made < 2 {
+        t.Errorf("made %d predictionsForMultiStops requests, want at least 2", made)
+      }
+
+      if len(results) != len(stops) {
+        t.Fatalf("got results for %d stops, want %d", len(results), len(stops))
+      }
+
+      for _, rs := range stops {
+        preds := results[rs]
+        if len(preds) != 1 {
+          t.Errorf("stop %s: got %d predictions, want 1", rs.Stop, len(preds))
+          continue
+        }
+        if preds[0].Stop.Tag != rs.Stop || preds[0].Service.Tag != "N_O" {
+          t.Errorf("stop %s: prediction for stop %s service %s", rs.Stop, preds[0].Stop.Tag, preds[0].Service.Tag)
+        }
+      }
+    })
+  }
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Observer receives events about the work an ApiHandler does, eg to
+// export metrics. Methods are called synchronously from the goroutine
+// making the request, and must be safe for concurrent use.
+type Observer interface {
+  // Called once a request has finished, after any retries
+  ObserveRequest(e RequestEvent)
+  // Called each time a failed attempt is about to be retried
+  ObserveRetry(command string, class RetryClass)
+  // Called whenever a cache layer is consulted, eg "agencies",
+  // "routes", "predictions", "inflight" for coalesced requests, or
+  // "stale" when an open circuit is answered from an expired cache
+  ObserveCache(layer string, hit bool)
+  // Called with the time each attempt spent waiting on the rate limiter
+  ObserveRateLimitWait(d time.Duration)
+}
+
+// RequestEvent describes a finished feed request.
+type RequestEvent struct {
+  // The feed command, eg "routeConfig"
+  Command   string
+  // One of the Outcome constants
+  Outcome   string
+  // Attempts made, including the first
+  Attempts  int
+  // Time from the first attempt starting to the last one finishing
+  Latency   time.Duration
+  // Size of the final response body
+  Bytes     int
+  // Bytes received on the wire for the final response, before
+  // decompression
+  WireBytes int64
+}
+
+// Outcomes reported in RequestEvent
+const (
+  OutcomeSuccess      string = "success"
+  OutcomeFeedError    string = "feed_error"
+  OutcomeRateLimited  string = "rate_limited"
+  OutcomeCanceled     string = "canceled"
+  OutcomeHTTPError    string = "http_error"
+  OutcomeDecodeError  string = "decode_error"
+  OutcomeTooLarge     string = "too_large"
+  OutcomeNetworkError string = "network_error"
+  OutcomeCircuitOpen  string = "circuit_open"
+)
+
+func WithObserver(o Observer) ApiOption {
+  return func(a *ApiHandler) {
+    a.observer = o
+  }
+}
+
+func requestOutcome(resp *ApiResponse) string {
+  err := resp.Error()
+  if err == nil {
+    return OutcomeSuccess
+  }
+
+  var fe *FeedError
+  if errors.As(err, &fe) {
+    return OutcomeFeedError
+  }
+
+  var rle *RateLimitError
+  if errors.As(err, &rle) {
+    return OutcomeRateLimited
+  }
+
+  var coe *CircuitOpenError
+  if errors.As(err, &coe) {
+    return OutcomeCircuitOpen
+  }
+
+  if errors.Is(err, context.Canceled) {
+    return OutcomeCanceled
+  }
+
+  var hse *HTTPStatusError
+  if errors.As(err, &hse) {
+    return OutcomeHTTPError
+  }
+
+  var de *DecodeError
+  if errors.As(err, &de) {
+    return OutcomeDecodeError
+  }
+
+  var rtl *ResponseTooLargeError
+  if errors.As(err, &rtl) {
+    return OutcomeTooLarge
+  }
+
+  return OutcomeNetworkError
+}
+
+func (a *ApiHandler) observeRequest(m ApiMethod, attempts int, elapsed time.Duration, resp *ApiResponse) {
+  if a.observer == nil {
+    return
+  }
+
+  a.observer.ObserveRequest(RequestEvent{
+    Command: m.Command,
+    Outcome: requestOutcome(resp),
+    Attempts: attempts,
+    Latency: elapsed,
+    Bytes: len(resp.Data),
+    WireBytes: resp.CompressedSize,
+  })
+}
+
+func (a *ApiHandler) observeRetry(m ApiMethod, class RetryClass) {
+  if a.observer == nil {
+    return
+  }
+
+  a.observer.ObserveRetry(m.Command, class)
+}
+
+func (a *ApiHandler) observeRateLimitWait(d time.Duration) {
+  if a.observer == nil {
+    return
+  }
+
+  a.observer.ObserveRateLimitWait(d)
+}
+
+// logs and observes whether a cache layer answered a call
+func (a *ApiHandler) cacheLookup(ctx context.Context, layer string, hit bool, attrs ...slog.Attr) {
+  a.logCache(ctx, layer, hit, attrs...)
+  if a.observer != nil {
+    a.observer.ObserveCache(layer, hit)
+  }
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -14,10 +15,10 @@ type Prediction struct {
   // The particular route for this predicted
   // arrival
   Route             *Route
-  // the ETA for this predicted arrival. This may 
-  // be from live data, or from a pre-set schedule.
-  // check "ScheduleBased" to determine what the source
-  // of the data is.
+  // the ETA for this predicted arrival, in the agency's
+  // time zone. This may be from live data, or from a
+  // pre-set schedule. check "ScheduleBased" to determine
+  // what the source of the data is.
   Eta               time.Time
   // Minutes until the estimated arrival. UmoIQ recommends
   // using this value for user-facing data, rather than Seconds
@@ -48,6 +49,16 @@ type Prediction struct {
   // for the past several minutes, indicating possible traffic
   // or other delays.
   Delayed           bool
+  // ID of the vehicle the prediction is for, resolve it to a live
+  // position with GetVehicle
+  VehicleID         string
+  // The block, or run of trips, the vehicle is assigned to
+  Block             string
+  // Number of cars in a multi-car consist, 0 if the feed gave none
+  VehiclesInConsist int
+  // How much slower than expected the vehicle has been travelling,
+  // only provided by some agencies
+  Slowness          float64
   // When this prediction was made, can be used for determining when to
   // refresh a prediction or predictions
   PredictionTime    time.Time
@@ -55,7 +66,7 @@ type Prediction struct {
   agency            *Agency
 }
 
-func (p *Prediction) unmarshalPrediction(v interface{}) (error) {
+func (p *Prediction) unmarshalPrediction(ctx context.Context, v interface{}) (error) {
   pIface, ok := v.(map[string]interface{})
   if !ok {
     return errors.New("Could not unmarshal prediction to map[string]interface{}")
@@ -65,7 +76,15 @@ func (p *Prediction) unmarshalPrediction(v interface{}) (error) {
   if !ok {
     return errors.New("Could not get service from prediction")
   }
-  svc, err := p.agency.GetService(svcTag)
+  var svc *Service
+  var err error
+  if p.Route != nil {
+    // the route is already known, so the agency's route cache is left
+    // alone
+    svc, err = p.Route.GetService(svcTag)
+  } else {
+    svc, err = p.agency.GetServiceContext(ctx, svcTag)
+  }
   if err != nil {
     return err
   }
@@ -77,7 +96,7 @@ func (p *Prediction) unmarshalPrediction(v interface{}) (error) {
   if !ok {
     return errors.New("Could not get prediction time from response")
   }
-  p.Eta = time.UnixMilli(int64(etaVal))
+  p.Eta = time.UnixMilli(int64(etaVal)).In(p.agency.location())
 
   min, ok := utils.IfaceToInt(pIface["minutes"])
   if ok {
@@ -111,6 +130,26 @@ func (p *Prediction) unmarshalPrediction(v interface{}) (error) {
   delayed, _ := utils.IfaceToBool(pIface["delayed"])
   p.Delayed = delayed
 
+  vehicle, ok := utils.IfaceToString(pIface["vehicle"])
+  if ok {
+    p.VehicleID = vehicle
+  }
+
+  block, ok := utils.IfaceToString(pIface["block"])
+  if ok {
+    p.Block = block
+  }
+
+  consist, ok := utils.IfaceToInt(pIface["vehiclesInConsist"])
+  if ok {
+    p.VehiclesInConsist = consist
+  }
+
+  slowness, ok := utils.IfaceToFloat(pIface["slowness"])
+  if ok {
+    p.Slowness = slowness
+  }
+
   if p.PredictionTime.IsZero() {
     p.PredictionTime = time.Now()
   }
@@ -118,15 +157,13 @@ func (p *Prediction) unmarshalPrediction(v interface{}) (error) {
   return nil
 }
 
-func unmarshalPredictionServiceRoutes(v interface{}, stop *Stop) ([]*Prediction, error) {
+// route may be nil, the route of each prediction is then looked up by
+// its service
+func unmarshalPredictionServiceRoutes(ctx context.Context, v interface{}, stop *Stop, route *Route) ([]*Prediction, error) {
   preds := make([]*Prediction, 0)
-  svcPreds, ok := v.([]interface{})
+  svcPreds, ok := utils.IfaceToSlice(v)
   if !ok {
-    svcPredSingle, ok := v.(map[string]interface{})
-    if !ok {
-      return nil, errors.New("ServicePredictionsUnmarshalErr")
-    }
-    svcPreds = []interface{}{svcPredSingle}
+    return nil, errors.New("ServicePredictionsUnmarshalErr")
   }
 
   for _, svc := range svcPreds {
@@ -135,14 +172,9 @@ func unmarshalPredictionServiceRoutes(v interface{}, stop *Stop) ([]*Prediction,
       continue
     }
 
-    spPreds, ok := sp["prediction"].([]interface{})
+    spPreds, ok := utils.IfaceToSlice(sp["prediction"])
     if !ok {
-      spPredSingle, ok := sp["prediction"].(map[string]interface{})
-      if !ok {
-        continue
-      }
-
-      spPreds = []interface{}{spPredSingle}
+      continue
     }
 
     now := time.Now()
@@ -150,10 +182,11 @@ func unmarshalPredictionServiceRoutes(v interface{}, stop *Stop) ([]*Prediction,
       p := &Prediction{
         agency: stop.agency,
         Stop: stop,
+        Route: route,
         PredictionTime: now,
       }
 
-      err := p.unmarshalPrediction(pred)
+      err := p.unmarshalPrediction(ctx, pred)
       if err != nil {
         return nil, err
       }
@@ -163,4 +196,76 @@ func unmarshalPredictionServiceRoutes(v interface{}, stop *Stop) ([]*Prediction,
   }
 
   return preds, nil
-} 
+}
+
+// FormatEta formats the ETA in the agency's time zone, eg
+// p.FormatEta("3:04pm") for a rider facing arrival time.
+func (p *Prediction) FormatEta(layout string) string {
+  return p.Eta.Format(layout)
+}
+
+// GetVehicle resolves the prediction to the live position of its
+// vehicle, polling the vehicles of the prediction's route.
+func (p *Prediction) GetVehicle(opts...ApiHandlerOption) (*Vehicle, error) {
+  return p.GetVehicleContext(p.agency.api.contextFor(opts), opts...)
+}
+
+func (p *Prediction) GetVehicleContext(ctx context.Context, opts...ApiHandlerOption) (*Vehicle, error) {
+  if p.VehicleID == "" {
+    return nil, errors.New("NoVehicleErr")
+  }
+
+  vehicles, err := p.agency.GetVehiclesContext(ctx, p.Route.Tag, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, v := range vehicles {
+    if v.ID == p.VehicleID {
+      return v, nil
+    }
+  }
+
+  // the vehicle may be reporting under another route, eg when it is
+  // about to switch routes on its block
+  return p.agency.GetVehicleContext(ctx, p.VehicleID, opts...)
+}
+
+// GetConsist returns the live positions of every car in the predicted
+// vehicle's consist, the leading car first. A vehicle running alone is
+// returned on its own.
+func (p *Prediction) GetConsist(opts...ApiHandlerOption) ([]*Vehicle, error) {
+  return p.GetConsistContext(p.agency.api.contextFor(opts), opts...)
+}
+
+func (p *Prediction) GetConsistContext(ctx context.Context, opts...ApiHandlerOption) ([]*Vehicle, error) {
+  v, err := p.GetVehicleContext(ctx, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  lead := v.ID
+  if v.LeadingVehicleID != "" {
+    lead = v.LeadingVehicleID
+  }
+
+  vehicles, err := p.agency.GetVehiclesContext(ctx, v.RouteTag, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  consist := make([]*Vehicle, 0, p.VehiclesInConsist)
+  for _, cv := range vehicles {
+    if cv.ID == lead {
+      consist = append([]*Vehicle{cv}, consist...)
+    } else if cv.LeadingVehicleID == lead {
+      consist = append(consist, cv)
+    }
+  }
+
+  if len(consist) == 0 {
+    consist = append(consist, v)
+  }
+
+  return consist, nil
+}
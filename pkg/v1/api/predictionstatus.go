@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lcyvin/go-umoparse/internal/utils"
+)
+
+// PredictionStatus tells what a route's predictions at a stop are
+// based on, or that there are none.
+type PredictionStatus int
+
+const (
+  // at least one prediction comes from live vehicle positions
+  PredictionsLive PredictionStatus = iota
+  // every prediction comes from the schedule
+  PredictionsScheduleOnly
+  // the feed has no predictions for the route, eg outside its service
+  // hours
+  NoPredictions
+)
+
+func (s PredictionStatus) String() string {
+  switch s {
+  case PredictionsLive:
+    return "live"
+  case PredictionsScheduleOnly:
+    return "schedule_only"
+  case NoPredictions:
+    return "no_predictions"
+  }
+
+  return "unknown"
+}
+
+// StopPredictions is a predictions response for a stop, with an entry
+// for each route serving it whether or not it has predictions.
+type StopPredictions struct {
+  Stop   *Stop
+  Routes []*RoutePredictions
+}
+
+// RoutePredictions is one route's part of a predictions response.
+type RoutePredictions struct {
+  RouteTag       string
+  // Titles as given in the response, short titles if the agency uses
+  // them
+  RouteTitle     string
+  StopTitle      string
+  Status         PredictionStatus
+  // The direction the predictions are for, the first one if there are
+  // several. Without predictions this is the direction the feed gave
+  // as the reason, eg "Inbound to Downtown".
+  DirectionTitle string
+  Predictions    []*Prediction
+  // Messages sent along with the predictions, see Agency.GetMessages
+  // for the full details of each
+  Messages       []*PredictionMessage
+  agency         *Agency
+}
+
+// PredictionMessage is a message the feed sends inline with predictions.
+type PredictionMessage struct {
+  Text     string
+  Priority string
+}
+
+func (rp *RoutePredictions) GetRoute() (*Route, error) {
+  return rp.agency.GetRoute(rp.RouteTag)
+}
+
+// Predictions returns the predictions of every route, in response order.
+func (sp *StopPredictions) Predictions() []*Prediction {
+  preds := make([]*Prediction, 0)
+  for _, rp := range sp.Routes {
+    preds = append(preds, rp.Predictions...)
+  }
+
+  return preds
+}
+
+// Route returns the entry for the route, false if the route doesn't serve
+// the stop.
+func (sp *StopPredictions) Route(routeTag string) (*RoutePredictions, bool) {
+  for _, rp := range sp.Routes {
+    if rp.RouteTag == routeTag {
+      return rp, true
+    }
+  }
+
+  return nil, false
+}
+
+// route may be nil if it is not known yet, see
+// unmarshalPredictionServiceRoutes
+func unmarshalRoutePredictions(ctx context.Context, rp map[string]interface{}, stop *Stop, route *Route) (*RoutePredictions, error) {
+  r := &RoutePredictions{
+    Status: NoPredictions,
+    Predictions: make([]*Prediction, 0),
+    Messages: make([]*PredictionMessage, 0),
+    agency: stop.agency,
+  }
+
+  r.RouteTag, _ = utils.IfaceToString(rp["routeTag"])
+  r.RouteTitle, _ = utils.IfaceToString(rp["routeTitle"])
+  r.StopTitle, _ = utils.IfaceToString(rp["stopTitle"])
+
+  msgs, _ := utils.IfaceToSlice(rp["message"])
+  for _, msgProto := range msgs {
+    msg, ok := msgProto.(map[string]interface{})
+    if !ok {
+      continue
+    }
+
+    m := &PredictionMessage{}
+    m.Text, _ = utils.IfaceToString(msg["text"])
+    m.Priority, _ = utils.IfaceToString(msg["priority"])
+    r.Messages = append(r.Messages, m)
+  }
+
+  reason, ok := utils.IfaceToString(rp["dirTitleBecauseNoPredictions"])
+  if ok {
+    r.DirectionTitle = reason
+    return r, nil
+  }
+
+  dirs, ok := rp["direction"]
+  if !ok {
+    return r, nil
+  }
+
+  dirList, ok := utils.IfaceToSlice(dirs)
+  if ok && len(dirList) > 0 {
+    dir, ok := dirList[0].(map[string]interface{})
+    if ok {
+      r.DirectionTitle, _ = utils.IfaceToString(dir["title"])
+    }
+  }
+
+  preds, err := unmarshalPredictionServiceRoutes(ctx, dirs, stop, route)
+  if err != nil {
+    return nil, err
+  }
+  r.Predictions = preds
+
+  if len(preds) == 0 {
+    return r, nil
+  }
+
+  r.Status = PredictionsScheduleOnly
+  for _, p := range preds {
+    if !p.ScheduleBased {
+      r.Status = PredictionsLive
+      break
+    }
+  }
+
+  return r, nil
+}
+
+// unmarshals a predictions response for the stop
+func (s *Stop) unmarshalStopPredictions(ctx context.Context, pIface map[string]interface{}) (*StopPredictions, error) {
+  sp := &StopPredictions{
+    Stop: s,
+    Routes: make([]*RoutePredictions, 0),
+  }
+
+  // we need to test if there's only one object or an array returned,
+  // because UmoIQ doesn't maintain schema when there's only one
+  // item in a response
+  preds, ok := pIface["predictions"]
+  if !ok {
+    return nil, errors.New("PredictionUnmarshalErr")
+  }
+
+  predArray, ok := utils.IfaceToSlice(preds)
+  if !ok {
+    return nil, errors.New("PredictionUnmarshalErr")
+  }
+  for _, routePreds := range predArray {
+    rp, ok := routePreds.(map[string]interface{})
+    if !ok {
+      return nil, errors.New("RoutePredictionUnmarshalErr")
+    }
+
+    r, err := unmarshalRoutePredictions(ctx, rp, s, nil)
+    if err != nil {
+      return nil, err
+    }
+
+    sp.Routes = append(sp.Routes, r)
+  }
+
+  return sp, nil
+}
@@ -0,0 +1,315 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Priority orders requests that are waiting on the rate limiter.
+type Priority int
+
+const (
+  // refreshes the user is not directly waiting on, eg reloading
+  // agency lists and route configs
+  PriorityBackground Priority = iota
+  // requests a user is waiting on, eg stop predictions
+  PriorityInteractive
+)
+
+// RateLimitConfig configures the client side limiter shared by every
+// request made through an ApiHandler. The limiter counts requests and
+// response bytes over a sliding window.
+type RateLimitConfig struct {
+  // Length of the sliding window
+  Window             time.Duration
+  // Maximum requests started within the window, 0 for no limit
+  MaxRequests        int
+  // Maximum response bytes received within the window, 0 for no limit
+  MaxBytes           int64
+  // Return a RateLimitError straight away instead of waiting for the
+  // budget to free up
+  FailFast           bool
+  // Fraction (0-1) of the budget that background requests may not use,
+  // so that interactive requests are not starved by refreshes
+  InteractiveReserve float64
+  // Bytes counted against MaxBytes for a request while its response is
+  // in flight, replaced by the real size once it arrives. 0 to use the
+  // average size of recent responses
+  EstimatedBytes     int64
+}
+
+// Bytes reserved for an in-flight request before any response size is
+// known, see RateLimitConfig.EstimatedBytes
+const defaultEstimatedBytes int64 = 16*1024
+
+// Per UmoIQ, clients may receive at most 2MB of data per 20 seconds
+// before being throttled or banned. Every handler uses this unless
+// given WithRateLimit or WithoutRateLimit.
+var DefaultRateLimitConfig = RateLimitConfig{
+  Window: 20*time.Second,
+  MaxBytes: 2*1024*1024,
+  InteractiveReserve: 0.2,
+}
+
+func WithRateLimit(cfg RateLimitConfig) ApiOption {
+  return func(a *ApiHandler) {
+    a.limiter = newRateLimiter(cfg)
+  }
+}
+
+// Disables client side rate limiting. Only use this if requests are
+// throttled elsewhere, the feed bans clients that exceed its limits.
+func WithoutRateLimit() ApiOption {
+  return func(a *ApiHandler) {
+    a.limiter = nil
+  }
+}
+
+// RateLimitError is returned by a fail-fast limiter when the budget for
+// the current window is spent.
+type RateLimitError struct {
+  // Time until enough of the window expires for the request to be
+  // allowed, zero if unknown
+  Wait time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+  return fmt.Sprintf("client rate limit reached, budget frees in %s", e.Wait)
+}
+
+// RateBudget is a snapshot of the limiter's usage of the current window.
+type RateBudget struct {
+  Window      time.Duration
+  Requests    int
+  MaxRequests int
+  // Includes Reserved
+  Bytes       int64
+  MaxBytes    int64
+  // Bytes estimated for requests whose responses haven't arrived yet
+  Reserved    int64
+  // Number of requests currently blocked waiting for budget
+  Waiting     int
+}
+
+// Reports the current usage of the handler's rate limit. If rate
+// limiting is disabled the zero value is returned.
+func (a *ApiHandler) RateBudget() RateBudget {
+  if a.limiter == nil {
+    return RateBudget{}
+  }
+
+  return a.limiter.budget()
+}
+
+type rateEvent struct {
+  at      time.Time
+  // an estimate until the response arrives
+  bytes   int64
+  pending bool
+}
+
+type rateLimiter struct {
+  mu       sync.Mutex
+  cfg      RateLimitConfig
+  events   []*rateEvent
+  waiting  map[Priority]int
+  // closed and replaced whenever waiters should re-check the budget
+  notify   chan struct{}
+  // moving average of response sizes, for estimating in-flight ones
+  avgBytes float64
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+  return &rateLimiter{
+    cfg: cfg,
+    events: make([]*rateEvent, 0),
+    waiting: make(map[Priority]int),
+    notify: make(chan struct{}),
+  }
+}
+
+// drops events that have left the window. Must hold mu.
+func (l *rateLimiter) prune(now time.Time) {
+  cutoff := now.Add(-l.cfg.Window)
+  i := 0
+  for i < len(l.events) && !l.events[i].at.After(cutoff) {
+    i++
+  }
+  l.events = l.events[i:]
+}
+
+// reports whether a request of priority p may start now. Must hold mu.
+func (l *rateLimiter) allowed(p Priority) bool {
+  scale := 1.0
+  if p < PriorityInteractive {
+    if l.waiting[PriorityInteractive] > 0 {
+      return false
+    }
+    scale = 1 - l.cfg.InteractiveReserve
+  }
+
+  if l.cfg.MaxRequests > 0 {
+    max := int(float64(l.cfg.MaxRequests) * scale)
+    if max < 1 {
+      max = 1
+    }
+    if len(l.events) >= max {
+      return false
+    }
+  }
+
+  if l.cfg.MaxBytes > 0 {
+    var used int64
+    for _, ev := range l.events {
+      used += ev.bytes
+    }
+    if float64(used) >= float64(l.cfg.MaxBytes)*scale {
+      return false
+    }
+  }
+
+  return true
+}
+
+// the bytes to reserve for a request that is about to start. Must hold
+// mu.
+func (l *rateLimiter) estimate() int64 {
+  if l.cfg.EstimatedBytes > 0 {
+    return l.cfg.EstimatedBytes
+  }
+
+  if l.avgBytes > 0 {
+    return int64(l.avgBytes)
+  }
+
+  return defaultEstimatedBytes
+}
+
+// wakes every waiter so they re-check the budget. Must hold mu.
+func (l *rateLimiter) broadcast() {
+  close(l.notify)
+  l.notify = make(chan struct{})
+}
+
+// reserves budget for one request, waiting if needed. Requests are
+// counted against MaxBytes with an estimated size until they are
+// recorded, so that concurrent requests can't all pass the check before
+// any of their responses arrive. It returns the event to record the
+// response size against and the time spent waiting.
+func (l *rateLimiter) acquire(ctx context.Context, p Priority) (*rateEvent, time.Duration, error) {
+  start := time.Now()
+  l.mu.Lock()
+  for {
+    now := time.Now()
+    l.prune(now)
+    if l.allowed(p) {
+      ev := &rateEvent{at: now, pending: true}
+      if l.cfg.MaxBytes > 0 {
+        ev.bytes = l.estimate()
+      }
+      l.events = append(l.events, ev)
+      l.mu.Unlock()
+      return ev, now.Sub(start), nil
+    }
+
+    // budget frees up when the oldest event leaves the window. If there
+    // are no events we are only held back by waiting interactive
+    // requests, and will be notified when they go through.
+    var wait time.Duration
+    if len(l.events) > 0 {
+      wait = l.events[0].at.Add(l.cfg.Window).Sub(now)
+    }
+
+    if l.cfg.FailFast {
+      l.mu.Unlock()
+      return nil, 0, &RateLimitError{Wait: wait}
+    }
+
+    notify := l.notify
+    l.waiting[p]++
+    l.mu.Unlock()
+
+    var t *time.Timer
+    var timer <-chan time.Time
+    if wait > 0 {
+      t = time.NewTimer(wait)
+      timer = t.C
+    }
+
+    var err error
+    select {
+    case <-ctx.Done():
+      err = ctx.Err()
+    case <-notify:
+    case <-timer:
+    }
+
+    if t != nil {
+      t.Stop()
+    }
+
+    l.mu.Lock()
+    l.waiting[p]--
+    if p == PriorityInteractive && l.waiting[p] == 0 {
+      l.broadcast()
+    }
+    if err != nil {
+      l.mu.Unlock()
+      return nil, time.Since(start), err
+    }
+  }
+}
+
+// records the size of the response for a request admitted by acquire,
+// replacing its estimate
+func (l *rateLimiter) record(ev *rateEvent, bytes int64) {
+  if ev == nil {
+    return
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  reserved := ev.bytes
+  ev.bytes = bytes
+  ev.pending = false
+
+  if l.avgBytes == 0 {
+    l.avgBytes = float64(bytes)
+  } else {
+    l.avgBytes = 0.8*l.avgBytes + 0.2*float64(bytes)
+  }
+
+  // the estimate was too high, waiters may fit in what it freed
+  if bytes < reserved {
+    l.broadcast()
+  }
+}
+
+func (l *rateLimiter) budget() RateBudget {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  l.prune(time.Now())
+  b := RateBudget{
+    Window: l.cfg.Window,
+    Requests: len(l.events),
+    MaxRequests: l.cfg.MaxRequests,
+    MaxBytes: l.cfg.MaxBytes,
+  }
+
+  for _, ev := range l.events {
+    b.Bytes += ev.bytes
+    if ev.pending {
+      b.Reserved += ev.bytes
+    }
+  }
+
+  for _, n := range l.waiting {
+    b.Waiting += n
+  }
+
+  return b
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Concurrent requests reserve an estimate each, so they can't all pass
+// the byte check before their responses are recorded.
+func TestRateLimitReservesInFlight(t *testing.T) {
+  l := newRateLimiter(RateLimitConfig{
+    Window: time.Minute,
+    MaxBytes: 100*1024,
+    FailFast: true,
+    EstimatedBytes: 40*1024,
+  })
+  ctx := context.Background()
+
+  events := make([]*rateEvent, 0)
+  for i := 0; i < 3; i++ {
+    ev, _, err := l.acquire(ctx, PriorityInteractive)
+    if err != nil {
+      t.Fatalf("request %d: %v", i, err)
+    }
+    events = append(events, ev)
+  }
+
+  _, _, err := l.acquire(ctx, PriorityInteractive)
+  var rle *RateLimitError
+  if !errors.As(err, &rle) {
+    t.Fatalf("got %v with 120KB reserved, want a RateLimitError", err)
+  }
+
+  b := l.budget()
+  if b.Reserved != 120*1024 || b.Bytes != 120*1024 {
+    t.Errorf("got %d reserved of %d bytes, want 120KB of 120KB", b.Reserved, b.Bytes)
+  }
+
+  // responses smaller than estimated hand the rest back
+  l.record(events[0], 1024)
+  l.record(events[1], 1024)
+  _, _, err = l.acquire(ctx, PriorityInteractive)
+  if err != nil {
+    t.Fatalf("got %v after responses came in under the estimate", err)
+  }
+
+  b = l.budget()
+  if b.Reserved != 80*1024 || b.Bytes != 82*1024 {
+    t.Errorf("got %d reserved of %d bytes, want 80KB of 82KB", b.Reserved, b.Bytes)
+  }
+}
+
+// Without a configured estimate the average of recent responses is used.
+func TestRateLimitEstimateAverages(t *testing.T) {
+  l := newRateLimiter(RateLimitConfig{Window: time.Minute, MaxBytes: 1 << 20})
+  if got := l.estimate(); got != defaultEstimatedBytes {
+    t.Errorf("got estimate %d before any response, want %d", got, defaultEstimatedBytes)
+  }
+
+  ev, _, err := l.acquire(context.Background(), PriorityInteractive)
+  if err != nil {
+    t.Fatal(err)
+  }
+  l.record(ev, 2000)
+
+  if got := l.estimate(); got != 2000 {
+    t.Errorf("got estimate %d, want 2000", got)
+  }
+}
+
+// A waiting request is let through when a response comes in under its
+// estimate, rather than when the window moves on.
+func TestRateLimitWakesOnRecord(t *testing.T) {
+  l := newRateLimiter(RateLimitConfig{
+    Window: time.Hour,
+    MaxBytes: 50*1024,
+    EstimatedBytes: 50*1024,
+  })
+  ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+
+  ev, _, err := l.acquire(ctx, PriorityInteractive)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  done := make(chan error)
+  go func() {
+    _, _, err := l.acquire(ctx, PriorityInteractive)
+    done <- err
+  }()
+
+  time.Sleep(20*time.Millisecond)
+  l.record(ev, 1024)
+
+  err = <-done
+  if err != nil {
+    t.Fatal(err)
+  }
+}
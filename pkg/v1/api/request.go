@@ -3,26 +3,29 @@ package api
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lcyvin/go-umoparse/internal/utils"
 )
 
-const API_URI string = "https://retro.umoiq.com/service/publicJSONFeed"
+const API_URI string = API_BASE_URI + "/" + jsonFeedPath
+const jsonFeedPath string = "publicJSONFeed"
 var DefaultApiHandlerOptions *ApiHandlerOptions = &ApiHandlerOptions{
   UseCache: true,
   CacheMaxAge: 60,
 }
 
 var DefaultApiHandler *ApiHandler = NewApiHandler(&GetConfig{
-  Timeout: 30,
+  Timeout: 30*time.Second,
   RetryLimit: 0,
-  RetryDelay: 100,
+  RetryDelay: 100*time.Millisecond,
   CustomHeaders: nil,
   Context: context.TODO(),
 })
@@ -36,6 +39,21 @@ func WithMaxCacheAge(seconds int) ApiOption {
   }
 }
 
+// Verbose routeConfig responses for the largest agencies run to a few
+// megabytes, this leaves plenty of headroom.
+const DefaultMaxResponseSize int64 = 32*1024*1024
+
+// Sets the largest response body, after decompression, that the handler
+// will read. Larger responses fail with a ResponseTooLargeError. A size
+// of 0 removes the limit.
+func WithMaxResponseSize(bytes int64) ApiOption {
+  return func(a *ApiHandler) {
+    a.maxResponseSize = bytes
+  }
+}
+
+// Sets the client used by the ClientMiddleware that ends the handler's
+// middleware chain.
 func WithHttpClient(c *http.Client) ApiOption {
   return func(a *ApiHandler) {
     a.c = c
@@ -43,54 +61,242 @@ func WithHttpClient(c *http.Client) ApiOption {
 }
 
 type ApiHandler struct {
-  cfg         *GetConfig
+  cfg               *GetConfig
   // cache to hold retrieved agencies to prevent
   // redundant requests to the API
-  agencies    []*Agency
-  cacheAge    time.Time
-  cacheMaxAge time.Duration
-  c           *http.Client
+  agencies          []*Agency
+  cacheAge          time.Time
+  // guards agencies and cacheAge
+  cacheMu           sync.Mutex
+  cacheMaxAge       time.Duration
+  c                 *http.Client
+  // policy for retrying failed requests, if nil one is built
+  // from cfg
+  retry             RetryPolicy
+  // shared by every request made through this handler, nil if
+  // rate limiting is disabled
+  limiter           *rateLimiter
+  endpoints         *endpointSet
+  failoverAfter     time.Duration
+  failbackAfter     time.Duration
+  backend           Backend
+  // user middlewares, outermost first
+  middleware        []Middleware
+  flights           flightGroup
+  logger            *slog.Logger
+  observer          Observer
+  // largest response body accepted, 0 for no limit
+  maxResponseSize   int64
+  // nil unless WithCircuitBreaker is used
+  breaker           *circuitBreaker
+  // vehicle positions by agency tag, see Agency.GetVehicles
+  fleets            map[string]*fleet
+  fleetsMu          sync.Mutex
+  vehicleStaleAfter time.Duration
+  // agency locations set with WithAgencyLocation
+  locations         map[string]*time.Location
+}
+
+// Get performs the request for m. Options override the handler's
+// GetConfig for this request only.
+func (a *ApiHandler) Get(m ApiMethod, opts...GetOpt) (*ApiResponse) {
+  cfg := a.callConfig(opts)
+  return a.do(configContext(cfg), m, PriorityInteractive, cfg)
+}
+
+// GetContext performs the request for m, retrying as the handler's
+// policy allows. Cancelling ctx stops the request and any retries.
+// Options override the handler's GetConfig for this request only,
+// though ctx always takes precedence over WithContext.
+func (a *ApiHandler) GetContext(ctx context.Context, m ApiMethod, opts...GetOpt) (*ApiResponse) {
+  return a.do(ctx, m, PriorityInteractive, a.callConfig(opts))
 }
 
-func (a *ApiHandler) Get(m ApiMethod) (*ApiResponse) {
-  cfg := a.cfg
-  if cfg.RetryDelay < 50 {
+// performs the request for m, sharing the response with any identical
+// requests made while it is in flight
+func (a *ApiHandler) do(ctx context.Context, m ApiMethod, p Priority, cfg *GetConfig) (*ApiResponse) {
+  resp, shared := a.flights.do(ctx, flightKey(m, cfg), func() *ApiResponse {
+    return a.retryDo(ctx, m, p, cfg)
+  })
+
+  // the caller that made the shared request gave up, but we haven't
+  if shared && isContextErr(resp.Error()) && ctx.Err() == nil {
+    resp = a.retryDo(ctx, m, p, cfg)
+    shared = false
+  }
+
+  if shared {
+    a.flights.saved.Add(1)
+    a.logCoalesced(ctx, m)
+  }
+  if a.observer != nil {
+    a.observer.ObserveCache("inflight", shared)
+  }
+
+  return resp
+}
+
+// performs the request for m and returns its decoded body
+func (a *ApiHandler) fetch(ctx context.Context, m ApiMethod, p Priority, opts...GetOpt) (map[string]interface{}, error) {
+  resp := a.do(ctx, m, p, a.callConfig(opts))
+  if resp.Error() != nil {
+    return nil, resp.Error()
+  }
+
+  return a.decode(m, resp)
+}
+
+// the context requests are made with when the caller gives none
+func (a *ApiHandler) context() context.Context {
+  return configContext(a.cfg)
+}
+
+// the context for a call to a method without a ctx argument, taken from
+// any WithContext passed through WithGetOpts
+func (a *ApiHandler) contextFor(opts []ApiHandlerOption) context.Context {
+  aho := &ApiHandlerOptions{}
+  for _, opt := range opts {
+    opt(aho)
+  }
+
+  return configContext(a.callConfig(aho.GetOpts))
+}
+
+func configContext(cfg *GetConfig) context.Context {
+  if cfg.Context == nil {
+    return context.Background()
+  }
+
+  return cfg.Context
+}
+
+// layers per-call options over a copy of the handler's config, so that
+// the shared config is never modified
+func (a *ApiHandler) callConfig(opts []GetOpt) *GetConfig {
+  cfg := *a.cfg
+  cfg.CustomHeaders = make(map[string]string, len(a.cfg.CustomHeaders))
+  for k, v := range a.cfg.CustomHeaders {
+    cfg.CustomHeaders[k] = v
+  }
+
+  for _, opt := range opts {
+    opt(&cfg)
+  }
+
+  return &cfg
+}
+
+// performs the request for m with retries, waiting on the rate limiter
+// at priority p before each attempt
+func (a *ApiHandler) retryDo(ctx context.Context, m ApiMethod, p Priority, cfg *GetConfig) (*ApiResponse) {
+  // both used to be plain ints, in seconds and milliseconds, which
+  // still compile as nanoseconds
+  if cfg.Timeout > 0 && cfg.Timeout < time.Millisecond {
     return &ApiResponse{
       Response: nil,
-      err: fmt.Errorf("Unable to use retry delay lower than 50ms"),
+      err: fmt.Errorf("Unable to use timeout of %v, Timeout is a time.Duration", cfg.Timeout),
     }
   }
 
-  if cfg.CustomHeaders == nil {
-    cfg.CustomHeaders = make(map[string]string)
+  policy := a.retry
+  if policy == nil {
+    if cfg.RetryDelay < 50*time.Millisecond {
+      return &ApiResponse{
+        Response: nil,
+        err: fmt.Errorf("Unable to use retry delay of %v, lower than 50ms", cfg.RetryDelay),
+      }
+    }
+    policy = configRetryPolicy(cfg)
   }
 
+  start := time.Now()
   var resp *ApiResponse
-  for i := 0; i <= 1+cfg.RetryLimit; i++ {
-    cctx := cfg.Context
-    var cancel context.CancelFunc
-    if cfg.Timeout != 0 {
-      cctx, cancel = context.WithTimeout(cfg.Context, time.Duration(cfg.Timeout)*time.Second)
-      defer cancel()
+  attempt := 1
+  for ; ; attempt++ {
+    resp = a.attempt(ctx, m, p, attempt, cfg)
+    class := ClassifyRetry(resp)
+    if class == RetryNone || ctx.Err() != nil {
+      break
+    }
+
+    delay, ok := policy.Backoff(attempt, time.Since(start), class, resp)
+    if !ok {
+      break
     }
+    a.observeRetry(m, class)
 
-    resp = get(cctx, m, cfg.CustomHeaders, a.c)
-    if resp.Error() != nil {
-      time.Sleep(time.Duration(cfg.RetryDelay)*time.Millisecond)
-      continue
+    err := sleepContext(ctx, delay)
+    if err != nil {
+      break
     }
   }
 
+  elapsed := time.Since(start)
+  a.logRequest(ctx, m, attempt, elapsed, resp)
+  a.observeRequest(m, attempt, elapsed, resp)
   return resp
 }
 
-func (a *ApiHandler) unmarshalAgencies(v interface{}) ([]*Agency, error) {
+// makes a single request, bounded by the configured timeout
+func (a *ApiHandler) attempt(ctx context.Context, m ApiMethod, p Priority, attempt int, cfg *GetConfig) *ApiResponse {
+  var trial bool
+  if a.breaker != nil {
+    ok, isTrial, until, change := a.breaker.allow()
+    a.circuitChanged(ctx, change)
+    if !ok {
+      return &ApiResponse{err: &CircuitOpenError{Command: m.Command, Until: until}}
+    }
+    trial = isTrial
+  }
+
+  var ev *rateEvent
+  if a.limiter != nil {
+    var err error
+    var waited time.Duration
+    ev, waited, err = a.limiter.acquire(ctx, p)
+    a.observeRateLimitWait(waited)
+    if err != nil {
+      a.releaseBreaker(ctx, trial)
+      return &ApiResponse{err: err}
+    }
+  }
+
+  parent := ctx
+  if cfg.Timeout != 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+    defer cancel()
+  }
+
+  base := a.endpoints.pick(a.failbackAfter)
+  start := time.Now()
+  resp := get(ctx, base+"/"+a.backend.FeedPath(), m, a.chain(cfg.CustomHeaders))
+  a.logAttempt(ctx, m, attempt, base, time.Since(start), resp)
+  if a.limiter != nil {
+    a.limiter.record(ev, resp.CompressedSize)
+  }
+
+  // don't blame the endpoint for the caller giving up
+  counted := parent.Err() == nil
+  class := ClassifyRetry(resp)
+  failed := class == RetryNetwork || class == RetryServerError
+  if counted {
+    a.endpoints.report(base, failed, a.failoverAfter)
+  }
+  if a.breaker != nil {
+    a.circuitChanged(ctx, a.breaker.record(trial, failed, counted))
+  }
+
+  return resp
+}
+
+func (a *ApiHandler) unmarshalAgencies(ctx context.Context, v interface{}) ([]*Agency, error) {
   obj, ok := v.(map[string]interface{})
   if !ok {
     return nil, errors.New("invalid input")
   }
 
-  agencyList, ok := obj["agency"].([]interface{})
+  agencyList, ok := utils.IfaceToSlice(obj["agency"])
   if !ok {
     return nil, errors.New("could not get agencies from response")
   }
@@ -133,6 +339,11 @@ func (a *ApiHandler) unmarshalAgencies(v interface{}) ([]*Agency, error) {
       a.RegionTitle = rTitle
     }
 
+    a.Location = a.api.agencyLocation(a.Tag, a.RegionTitle)
+    if a.Location == nil {
+      a.api.logUnknownZone(ctx, a.Tag, a.RegionTitle)
+    }
+
     agencies = append(agencies, a)
   }
 
@@ -140,42 +351,65 @@ func (a *ApiHandler) unmarshalAgencies(v interface{}) ([]*Agency, error) {
 }
 
 func (a *ApiHandler) GetAgencies(opts...ApiHandlerOption) ([]*Agency, error) {
-  aho := DefaultApiHandlerOptions
+  return a.GetAgenciesContext(a.contextFor(opts), opts...)
+}
+
+func (a *ApiHandler) GetAgenciesContext(ctx context.Context, opts...ApiHandlerOption) ([]*Agency, error) {
+  aho := *DefaultApiHandlerOptions
   for _, opt := range opts {
-    opt(aho)
+    opt(&aho)
   }
 
-  var useCache bool
+  a.cacheMu.Lock()
+  cached, cacheAge := a.agencies, a.cacheAge
+  a.cacheMu.Unlock()
 
-  if time.Now().Sub(a.cacheAge) > a.cacheMaxAge {
+  useCache := aho.UseCache
+  if time.Now().Sub(cacheAge) > a.cacheMaxAge {
     useCache = false
   }
 
-  if !aho.UseCache {
-    useCache = false
-  }
-
-  if a.agencies != nil && useCache {
-    return a.agencies, nil
+  if cached != nil && useCache {
+    a.cacheLookup(ctx, "agencies", true)
+    return cached, nil
   }
+  a.cacheLookup(ctx, "agencies", false)
 
-  resp := a.Get(MethodAgencyList())
-  if resp.Error() != nil {
-    return nil, resp.Error()
+  start := time.Now()
+  unmarshalIface, err := a.fetch(ctx, MethodAgencyList(), PriorityBackground, aho.GetOpts...)
+  if err != nil {
+    if cached != nil && a.serveStale(err) {
+      a.cacheLookup(ctx, "stale", true, slog.String("for", "agencies"))
+      return cached, nil
+    }
+    return nil, err
   }
 
-  unmarshalIface := make(map[string]interface{})
-  err := json.Unmarshal(resp.Data, &unmarshalIface)
+  agencies, err := a.unmarshalAgencies(ctx, unmarshalIface)
   if err != nil {
     return nil, err
   }
 
-  agencies, err := a.unmarshalAgencies(unmarshalIface)
+  a.cacheMu.Lock()
+  defer a.cacheMu.Unlock()
+
+  // keep agencies another caller fetched meanwhile, so that callers
+  // share the same routes cache
+  if a.cacheAge.After(start) {
+    return a.agencies, nil
+  }
+
+  a.agencies = agencies
+  a.cacheAge = time.Now()
   return agencies, nil
 }
 
 func (a *ApiHandler) GetAgency(agencyTag string, opts...ApiHandlerOption) (*Agency, error) {
-  agencies, err := a.GetAgencies(opts...)
+  return a.GetAgencyContext(a.contextFor(opts), agencyTag, opts...)
+}
+
+func (a *ApiHandler) GetAgencyContext(ctx context.Context, agencyTag string, opts...ApiHandlerOption) (*Agency, error) {
+  agencies, err := a.GetAgenciesContext(ctx, opts...)
   if err != nil {
     return nil, err
   }
@@ -189,11 +423,22 @@ func (a *ApiHandler) GetAgency(agencyTag string, opts...ApiHandlerOption) (*Agen
   return nil, &ApiNotExistErr{msg: "Agency "+agencyTag+" not found."}
 }
 
+// NewApiHandler builds a handler making requests with cfg. Unless
+// WithRateLimit or WithoutRateLimit is given, requests share a limiter
+// using DefaultRateLimitConfig, which keeps the handler within the
+// feed's limit of 2MB per 20 seconds by making requests wait.
 func NewApiHandler(cfg *GetConfig, opts... ApiOption) *ApiHandler {
   h := &ApiHandler{
     cfg: cfg,
-    cacheMaxAge: time.Duration(3600),
+    cacheMaxAge: 3600*time.Second,
     c: http.DefaultClient,
+    limiter: newRateLimiter(DefaultRateLimitConfig),
+    endpoints: newEndpointSet([]string{API_BASE_URI}),
+    failoverAfter: DefaultFailoverAfter,
+    failbackAfter: DefaultFailbackAfter,
+    backend: JSONBackend,
+    maxResponseSize: DefaultMaxResponseSize,
+    vehicleStaleAfter: DefaultVehicleStaleAfter,
   }
 
   for _, opt := range opts {
@@ -204,35 +449,46 @@ func NewApiHandler(cfg *GetConfig, opts... ApiOption) *ApiHandler {
 }
 
 type GetConfig struct {
-  // set optional request timeout instead of system/api default
-  Timeout       int
-  // Limit total number of retries. If not set, no retries will be done
+  // set optional timeout for each attempt of a request instead of
+  // the system/api default. Values under a millisecond are rejected
+  Timeout       time.Duration
+  // Limit total number of retries. If not set, no retries will be done.
+  // Ignored if the handler has a policy set with WithRetryPolicy
   RetryLimit    int
-  // Set delay between retries, in milliseconds
-  RetryDelay    int
+  // Set delay before the first retry, at least 50ms. Later retries back
+  // off exponentially from this value. Ignored if the handler has a
+  // policy set with WithRetryPolicy
+  RetryDelay    time.Duration
   // Set custom headers for this request
   CustomHeaders map[string]string
-  // use a custom context instead of the default context.Background()
+  // use a custom context instead of the default context.Background().
+  // Contexts passed to the ...Context methods take precedence
   Context       context.Context
 }
 
+// GetOpt overrides part of the handler's GetConfig for a single call,
+// see ApiHandler.Get and WithGetOpts.
 type GetOpt func(*GetConfig) 
 
-func WithTimeout(milli int) GetOpt {
+func WithTimeout(d time.Duration) GetOpt {
   return func(c *GetConfig) {
-    c.Timeout = milli
+    c.Timeout = d
   }
 }
 
+// Sets the retries allowed for a call. It has no effect on a handler
+// with a policy set with WithRetryPolicy.
 func WithRetryLimit(limit int) GetOpt {
   return func(c *GetConfig) {
     c.RetryLimit = limit
   }
 }
 
-func WithRetryDelay(milli int) GetOpt {
+// Sets the delay before a call's first retry. It has no effect on a
+// handler with a policy set with WithRetryPolicy.
+func WithRetryDelay(d time.Duration) GetOpt {
   return func(c *GetConfig) {
-    c.RetryDelay = milli
+    c.RetryDelay = d
   }
 }
 
@@ -242,67 +498,83 @@ func WithContext(ctx context.Context) GetOpt {
   }
 }
 
+// Adds headers to the request, replacing any of the handler's custom
+// headers with the same name.
 func WithHeaders(headers map[string]string) GetOpt {
   return func(c *GetConfig) {
-    c.CustomHeaders = headers
+    if c.CustomHeaders == nil {
+      c.CustomHeaders = make(map[string]string, len(headers))
+    }
+    for k, v := range headers {
+      c.CustomHeaders[k] = v
+    }
   }
 }
 
-type ApiMethod func() (string)
+type NoResponseError struct {
+  msg string
+}
 
-func MethodRoutes(agency string) ApiMethod {
-  return func() (string) {
-    return fmt.Sprintf("?command=routeList&a=%s", agency)
-  }
+func (e *NoResponseError) Error() string {
+  return e.msg
 }
 
-func MethodRouteConfig(agency, route string) ApiMethod {
-  return func() string {
-    return fmt.Sprintf("?command=routeConfig&a=%s&r=%s&verbose", agency, route)
-  }
+// FeedError is returned when the feed answers a request with an Error
+// object instead of the requested data. UmoIQ does this for bad commands,
+// unknown agencies and rate limit violations, all with an HTTP 200.
+type FeedError struct {
+  // The error text supplied by the feed
+  Message     string
+  // Per UmoIQ: signals that the same request may succeed if it is
+  // retried later, eg when the feed is temporarily overloaded
+  ShouldRetry bool
+  // The feed command that failed, eg "routeConfig"
+  Command     string
 }
 
-func MethodAgencyList() ApiMethod {
-  return func() string {
-    return "?command=agencyList"
-  }
+func (e *FeedError) Error() string {
+  return fmt.Sprintf("umoiq feed error for command %s: %s", e.Command, e.Message)
 }
 
-func MethodSchedule(agency, route string) ApiMethod {
-  return func() string {
-    return fmt.Sprintf("?command=schedule&a=%s&r=%s", agency, route)
+// checks a decoded response body for the feed's error envelope,
+// returning nil if the body is not an error
+func unmarshalFeedError(m ApiMethod, iface map[string]interface{}) *FeedError {
+  errProto, ok := iface["Error"]
+  if !ok {
+    return nil
   }
-}
 
-func MethodVehicleLocations(agency, route, time string) ApiMethod {
-  return func() string {
-    return fmt.Sprintf("?command=vehicleLocations&a=%s&r=%s&t=%s", agency, route, time)
+  // multiple errors may be returned as an array, we only report the first
+  errList, ok := errProto.([]interface{})
+  if ok {
+    if len(errList) == 0 {
+      return nil
+    }
+    errProto = errList[0]
   }
-}
 
-func MethodVehicleLocation(agency, vehicleId string) ApiMethod {
-  return func() string {
-    return fmt.Sprintf("?command=vehicleLocation&a=%s&v=%s", agency, vehicleId)
+  fe := &FeedError{
+    Command: m.Command,
   }
-}
 
-func MethodPredictions(agency, stopId, route string) ApiMethod {
-  return func() string {
-    apiCmd := fmt.Sprintf("?command=predictions&a=%s&stopId=%s", agency, stopId)
-    if route != "" {
-      apiCmd = apiCmd + "&routeTag=" + route
-    }
+  errIface, ok := errProto.(map[string]interface{})
+  if !ok {
+    msg, _ := utils.IfaceToString(errProto)
+    fe.Message = strings.TrimSpace(msg)
+    return fe
+  }
 
-    return apiCmd
+  msg, ok := utils.IfaceToString(errIface["content"])
+  if ok {
+    fe.Message = strings.TrimSpace(msg)
   }
-}
 
-type NoResponseError struct {
-  msg string
-}
+  retry, ok := utils.IfaceToBool(errIface["shouldRetry"])
+  if ok {
+    fe.ShouldRetry = retry
+  }
 
-func (e *NoResponseError) Error() string {
-  return e.msg
+  return fe
 }
 
 type ApiMethodResponse interface {
@@ -311,9 +583,18 @@ type ApiMethodResponse interface {
 }
 
 type ApiResponse struct {
-  Response *http.Response
-  err      error
-  Data     []byte
+  Response         *http.Response
+  err              error
+  Data             []byte
+  // Bytes received on the wire, before decompression
+  CompressedSize   int64
+  // Bytes of Data, after decompression
+  UncompressedSize int64
+  // Data decoded by the handler's backend, see ApiHandler.decode
+  body             map[string]interface{}
+  decodeErr        error
+  // shared responses are decoded by whichever caller gets there first
+  decodeOnce       sync.Once
 }
 
 func (ar *ApiResponse) Reader() (io.Reader) {
@@ -324,40 +605,21 @@ func (ar *ApiResponse) Error() error {
   return ar.err
 }
 
-func get(ctx context.Context, m ApiMethod, headers map[string]string, c *http.Client) (*ApiResponse) {
-  apiCmd := m()
-  apiResp := &ApiResponse{}
-  
-  request, err := http.NewRequestWithContext(ctx, http.MethodGet, API_URI+apiCmd, nil)
+func get(ctx context.Context, feedUri string, m ApiMethod, h RequestHandler) (*ApiResponse) {
+  request, err := http.NewRequestWithContext(ctx, http.MethodGet, feedUri+m.Query(), nil)
   if err != nil {
     return &ApiResponse{err: err}
   }
 
-  if headers != nil || len(headers) > 0 {
-    for k,v := range headers {
-      request.Header.Set(k, v)
-    }
-  }
-
-  resp, err := c.Do(request)
-  apiResp.Response = resp
-  apiResp.err = err
-  if err != nil {
-    return apiResp
-  }
-
-  data, err := io.ReadAll(resp.Body)
-  if err != nil {
-    apiResp.err = err
-  }
-
-  apiResp.Data = data
-
-  return apiResp
+  return h(m, request)
 }
 
 // Default client Get, to use custom request configuration create a new
 // api handler and call Get from that.
-func Get(m ApiMethod) *ApiResponse {
-  return DefaultApiHandler.Get(m)
+func Get(m ApiMethod, opts...GetOpt) *ApiResponse {
+  return DefaultApiHandler.Get(m, opts...)
+}
+
+func GetContext(ctx context.Context, m ApiMethod, opts...GetOpt) *ApiResponse {
+  return DefaultApiHandler.GetContext(ctx, m, opts...)
 }
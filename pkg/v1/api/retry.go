@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryClass describes why a failed request may be worth retrying.
+type RetryClass int
+
+const (
+  // the request succeeded, or failed in a way that retrying will not fix
+  RetryNone RetryClass = iota
+  // the request failed in transport, eg a refused connection or timeout
+  RetryNetwork
+  // the feed answered with a 5xx status
+  RetryServerError
+  // the feed returned an error envelope with shouldRetry set
+  RetryFeedError
+  // the feed reported that this client exceeded its usage limits
+  RetryRateLimited
+)
+
+func (c RetryClass) String() string {
+  switch c {
+  case RetryNone:
+    return "none"
+  case RetryNetwork:
+    return "network"
+  case RetryServerError:
+    return "server_error"
+  case RetryFeedError:
+    return "feed_error"
+  case RetryRateLimited:
+    return "rate_limited"
+  }
+
+  return "unknown"
+}
+
+// ClassifyRetry inspects a response and reports whether, and why, the
+// request that produced it may be retried.
+func ClassifyRetry(resp *ApiResponse) RetryClass {
+  if resp == nil {
+    return RetryNone
+  }
+
+  err := resp.Error()
+  var rle *RateLimitError
+  if errors.As(err, &rle) {
+    // our own limiter failed fast, the caller asked not to wait
+    return RetryNone
+  }
+
+  var coe *CircuitOpenError
+  if errors.As(err, &coe) {
+    // retrying is exactly what the breaker is there to stop
+    return RetryNone
+  }
+
+  var fe *FeedError
+  if errors.As(err, &fe) {
+    if isRateLimitMessage(fe.Message) {
+      return RetryRateLimited
+    }
+    if fe.ShouldRetry {
+      return RetryFeedError
+    }
+    return RetryNone
+  }
+
+  var hse *HTTPStatusError
+  if errors.As(err, &hse) {
+    switch {
+    case hse.StatusCode == http.StatusTooManyRequests:
+      return RetryRateLimited
+    case hse.StatusCode == http.StatusRequestTimeout:
+      return RetryNetwork
+    case hse.StatusCode >= 500:
+      return RetryServerError
+    }
+    return RetryNone
+  }
+
+  var de *DecodeError
+  var rtl *ResponseTooLargeError
+  if errors.As(err, &de) || errors.As(err, &rtl) {
+    return RetryNone
+  }
+
+  if err != nil {
+    return RetryNetwork
+  }
+
+  return RetryNone
+}
+
+// UmoIQ does not give rate limit violations their own error code, so
+// we match on the wording of the message instead.
+func isRateLimitMessage(msg string) bool {
+  msg = strings.ToLower(msg)
+  for _, s := range []string{"exceeded", "too many", "rate limit", "bandwidth"} {
+    if strings.Contains(msg, s) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// RetryPolicy decides if and when a failed request is attempted again.
+type RetryPolicy interface {
+  // Backoff is called after each failed attempt. attempt counts from 1
+  // and elapsed is the time since the first attempt began. It returns
+  // the delay before the next attempt, or false to give up.
+  Backoff(attempt int, elapsed time.Duration, class RetryClass, resp *ApiResponse) (time.Duration, bool)
+}
+
+// BackoffPolicy is the default RetryPolicy, retrying with exponential
+// backoff and jitter until either MaxRetries or MaxElapsed is reached.
+type BackoffPolicy struct {
+  // Maximum number of retries after the first attempt
+  MaxRetries     int
+  // Delay before the first retry
+  InitialDelay   time.Duration
+  // Upper bound for any single delay, ignored if zero
+  MaxDelay       time.Duration
+  // Growth factor applied to the delay for each further retry,
+  // values below 1 are treated as 1
+  Multiplier     float64
+  // Fraction (0-1) of each delay that is randomised, so that many
+  // clients failing at once don't retry in lockstep
+  Jitter         float64
+  // Give up once this much time would have passed since the first
+  // attempt, ignored if zero
+  MaxElapsed     time.Duration
+  // Minimum delay after the feed reports a rate limit violation
+  RateLimitDelay time.Duration
+}
+
+func (p *BackoffPolicy) Backoff(attempt int, elapsed time.Duration, class RetryClass, resp *ApiResponse) (time.Duration, bool) {
+  if class == RetryNone || attempt > p.MaxRetries {
+    return 0, false
+  }
+
+  mult := p.Multiplier
+  if mult < 1 {
+    mult = 1
+  }
+
+  delay := float64(p.InitialDelay) * math.Pow(mult, float64(attempt-1))
+  if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+    delay = float64(p.MaxDelay)
+  }
+
+  if p.Jitter > 0 {
+    jitter := math.Min(p.Jitter, 1)
+    delay = delay - (delay * jitter * rand.Float64())
+  }
+
+  d := time.Duration(delay)
+  if class == RetryRateLimited && d < p.RateLimitDelay {
+    d = p.RateLimitDelay
+  }
+
+  // the server knows better than our backoff when it will recover
+  ra := RetryAfter(resp)
+  if ra > d {
+    d = ra
+  }
+
+  if p.MaxElapsed > 0 && elapsed+d > p.MaxElapsed {
+    return 0, false
+  }
+
+  return d, true
+}
+
+// RetryAfter returns the delay the feed asked for with a Retry-After
+// header on resp, or zero if there was none.
+func RetryAfter(resp *ApiResponse) time.Duration {
+  if resp == nil {
+    return 0
+  }
+
+  var hse *HTTPStatusError
+  if errors.As(resp.Error(), &hse) {
+    return hse.RetryAfter
+  }
+
+  return 0
+}
+
+// builds the policy used when no RetryPolicy was given to the handler,
+// from the RetryLimit and RetryDelay of its GetConfig
+func configRetryPolicy(cfg *GetConfig) RetryPolicy {
+  return &BackoffPolicy{
+    MaxRetries: cfg.RetryLimit,
+    InitialDelay: cfg.RetryDelay,
+    MaxDelay: 30*time.Second,
+    Multiplier: 2,
+    Jitter: 0.2,
+    MaxElapsed: 2*time.Minute,
+    RateLimitDelay: 20*time.Second,
+  }
+}
+
+// Sets the policy used for every request, instead of the BackoffPolicy
+// built from RetryLimit and RetryDelay. The handler's GetConfig values
+// and the per-call WithRetryLimit and WithRetryDelay are then ignored.
+func WithRetryPolicy(p RetryPolicy) ApiOption {
+  return func(a *ApiHandler) {
+    a.retry = p
+  }
+}
+
+// sleeps for d, returning early with the context's error if it is
+// cancelled first
+func sleepContext(ctx context.Context, d time.Duration) error {
+  if d <= 0 {
+    return ctx.Err()
+  }
+
+  t := time.NewTimer(d)
+  defer t.Stop()
+
+  select {
+  case <-ctx.Done():
+    return ctx.Err()
+  case <-t.C:
+    return nil
+  }
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func statusResponse(code int, retryAfter time.Duration) *ApiResponse {
+  return &ApiResponse{err: &HTTPStatusError{StatusCode: code, Command: "agencyList", RetryAfter: retryAfter}}
+}
+
+func TestClassifyRetry(t *testing.T) {
+  tests := []struct {
+    name string
+    resp *ApiResponse
+    want RetryClass
+  }{
+    {"no response", nil, RetryNone},
+    {"success", &ApiResponse{}, RetryNone},
+    {"feed error", &ApiResponse{err: &FeedError{Message: "Agency parameter \"a=nope\" is not valid."}}, RetryNone},
+    {"retryable feed error", &ApiResponse{err: &FeedError{Message: "Feed is overloaded", ShouldRetry: true}}, RetryFeedError},
+    {"feed rate limit", &ApiResponse{err: &FeedError{Message: "Exceeded the bandwidth limit"}}, RetryRateLimited},
+    {"429", statusResponse(http.StatusTooManyRequests, 0), RetryRateLimited},
+    {"408", statusResponse(http.StatusRequestTimeout, 0), RetryNetwork},
+    {"503", statusResponse(http.StatusServiceUnavailable, 0), RetryServerError},
+    {"404", statusResponse(http.StatusNotFound, 0), RetryNone},
+    {"decode error", &ApiResponse{err: &DecodeError{Command: "agencyList", Err: errors.New("bad json")}}, RetryNone},
+    {"too large", &ApiResponse{err: &ResponseTooLargeError{Command: "agencyList"}}, RetryNone},
+    {"own rate limit", &ApiResponse{err: &RateLimitError{}}, RetryNone},
+    {"circuit open", &ApiResponse{err: &CircuitOpenError{Command: "agencyList"}}, RetryNone},
+    {"transport", &ApiResponse{err: &TransportError{Command: "agencyList", Err: errors.New("connection refused")}}, RetryNetwork},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      if got := ClassifyRetry(tt.resp); got != tt.want {
+        t.Errorf("got %s, want %s", got, tt.want)
+      }
+    })
+  }
+}
+
+func TestBackoffPolicy(t *testing.T) {
+  p := &BackoffPolicy{
+    MaxRetries: 5,
+    InitialDelay: 100*time.Millisecond,
+    MaxDelay: time.Second,
+    Multiplier: 2,
+    MaxElapsed: 10*time.Second,
+    RateLimitDelay: 5*time.Second,
+  }
+
+  tests := []struct {
+    name    string
+    policy  *BackoffPolicy
+    attempt int
+    elapsed time.Duration
+    class   RetryClass
+    resp    *ApiResponse
+    want    time.Duration
+    ok      bool
+  }{
+    {"first retry", p, 1, 0, RetryNetwork, nil, 100*time.Millisecond, true},
+    {"grows", p, 3, 0, RetryServerError, nil, 400*time.Millisecond, true},
+    {"capped", p, 5, 0, RetryServerError, nil, time.Second, true},
+    {"out of retries", p, 6, 0, RetryServerError, nil, 0, false},
+    {"not retryable", p, 1, 0, RetryNone, nil, 0, false},
+    {"rate limited", p, 1, 0, RetryRateLimited, nil, 5*time.Second, true},
+    {"retry-after", p, 1, 0, RetryServerError, statusResponse(http.StatusServiceUnavailable, 3*time.Second), 3*time.Second, true},
+    {"retry-after shorter", p, 3, 0, RetryServerError, statusResponse(http.StatusServiceUnavailable, time.Millisecond), 400*time.Millisecond, true},
+    {"past MaxElapsed", p, 1, 9950*time.Millisecond, RetryNetwork, nil, 0, false},
+    {"multiplier under 1", &BackoffPolicy{MaxRetries: 3, InitialDelay: 100*time.Millisecond, Multiplier: 0.5}, 3, 0, RetryNetwork, nil, 100*time.Millisecond, true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got, ok := tt.policy.Backoff(tt.attempt, tt.elapsed, tt.class, tt.resp)
+      if got != tt.want || ok != tt.ok {
+        t.Errorf("got %v %v, want %v %v", got, ok, tt.want, tt.ok)
+      }
+    })
+  }
+}
+
+func TestBackoffJitter(t *testing.T) {
+  p := &BackoffPolicy{MaxRetries: 1, InitialDelay: 100*time.Millisecond, Jitter: 0.5}
+  for i := 0; i < 100; i++ {
+    d, ok := p.Backoff(1, 0, RetryNetwork, nil)
+    if !ok || d < 50*time.Millisecond || d > 100*time.Millisecond {
+      t.Fatalf("got %v %v, want between 50ms and 100ms", d, ok)
+    }
+  }
+}
+
+// fails the first n requests with a 503
+func failFirst(n int32, requests *atomic.Int32) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if requests.Add(1) <= n {
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    w.Write([]byte(agencyListJSON))
+  }
+}
+
+func TestRetryDo(t *testing.T) {
+  policy := &BackoffPolicy{MaxRetries: 2, InitialDelay: time.Millisecond}
+
+  tests := []struct {
+    name     string
+    failures int32
+    requests int32
+    ok       bool
+  }{
+    {"first attempt", 0, 1, true},
+    {"retried", 2, 3, true},
+    {"gives up", 5, 3, false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      var requests atomic.Int32
+      h := newTestHandler(t, failFirst(tt.failures, &requests), WithRetryPolicy(policy))
+
+      resp := h.Get(MethodAgencyList())
+      if (resp.Error() == nil) != tt.ok {
+        t.Errorf("got %v", resp.Error())
+      }
+      if n := requests.Load(); n != tt.requests {
+        t.Errorf("got %d requests, want %d", n, tt.requests)
+      }
+
+      var hse *HTTPStatusError
+      if !tt.ok && !errors.As(resp.Error(), &hse) {
+        t.Errorf("got %v, want the last HTTPStatusError", resp.Error())
+      }
+    })
+  }
+}
+
+// Cancelling the context stops the retries waiting to be made.
+func TestRetryDoCancelled(t *testing.T) {
+  var requests atomic.Int32
+  h := newTestHandler(t, failFirst(100, &requests), WithRetryPolicy(&BackoffPolicy{MaxRetries: 5, InitialDelay: time.Hour}))
+
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+
+  start := time.Now()
+  h.GetContext(ctx, MethodAgencyList())
+  if time.Since(start) > time.Second {
+    t.Errorf("retry wait not cut short")
+  }
+  if n := requests.Load(); n != 1 {
+    t.Errorf("got %d requests, want 1", n)
+  }
+}
+
+// A handler's policy decides retries, not the per-call options.
+func TestRetryPolicyOverridesConfig(t *testing.T) {
+  var requests atomic.Int32
+  h := newTestHandler(t, failFirst(100, &requests), WithRetryPolicy(&BackoffPolicy{MaxRetries: 2, InitialDelay: time.Millisecond}))
+
+  h.Get(MethodAgencyList(), WithRetryLimit(0), WithRetryDelay(time.Hour))
+  if n := requests.Load(); n != 3 {
+    t.Errorf("got %d requests, want 3 from the policy", n)
+  }
+}
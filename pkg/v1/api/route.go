@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/lcyvin/go-umoparse/internal/utils"
 )
@@ -14,6 +16,8 @@ type Route struct {
   Stops       []*Stop
   api         *ApiHandler
   agency      *Agency
+  schedules   []*Schedule
+  scheduleAge time.Time
 }
 
 func (r *Route) GetService(tag string) (*Service, error) {
@@ -58,6 +62,16 @@ func (r *Route) GetStopByTag(stopTag string) (*Stop, error) {
   return nil, errors.New("StopNotFound")
 }
 
+// GetPredictionsAt fetches the predictions of the route at one of its
+// stops, see Stop.GetRoutePredictions.
+func (r *Route) GetPredictionsAt(stop *Stop, opts...ApiHandlerOption) ([]*Prediction, error) {
+  return stop.GetRoutePredictions(r.Tag, opts...)
+}
+
+func (r *Route) GetPredictionsAtContext(ctx context.Context, stop *Stop, opts...ApiHandlerOption) ([]*Prediction, error) {
+  return stop.GetRoutePredictionsContext(ctx, r.Tag, opts...)
+}
+
 func (a *Agency) unmarshalRouteConfig(v interface{}) (*Route, error) {
   iface, ok := v.(map[string]interface{})
   if !ok {
@@ -71,7 +85,7 @@ func (a *Agency) unmarshalRouteConfig(v interface{}) (*Route, error) {
   svcs := make([]*Service, 0)
   stops := make([]*Stop, 0)
   // extract our stops first
-  rteIface, ok := iface["route"].(map[string]interface{})
+  rteIface, ok := utils.IfaceToMap(iface["route"])
   if !ok {
     return nil, errors.New("could not get route from response")
   }
@@ -92,8 +106,7 @@ func (a *Agency) unmarshalRouteConfig(v interface{}) (*Route, error) {
     r.ShortTitle = title
   }
 
-  stopList, ok := rteIface["stop"].([]interface{})
-  
+  stopList, ok := utils.IfaceToSlice(rteIface["stop"])
   if !ok {
     return nil, errors.New("Could not get list of stops from routeConfig")
   }
@@ -112,14 +125,9 @@ func (a *Agency) unmarshalRouteConfig(v interface{}) (*Route, error) {
   }
   r.Stops = stops
 
-  var svcList []interface{}
-  svcList, ok = rteIface["direction"].([]interface{})
+  svcList, ok := utils.IfaceToSlice(rteIface["direction"])
   if !ok {
-    singleSvc, ok := rteIface["direction"].(map[string]interface{})
-    if !ok {
-      return nil, errors.New("Could not get service routes from routeConfig")
-    }
-    svcList = []interface{}{singleSvc}
+    return nil, errors.New("Could not get service routes from routeConfig")
   }
 
   for _, svcProto := range svcList {
@@ -166,7 +174,7 @@ func unmarshalServiceRoute(s *Service, v interface{}) error {
   }
 
   stops := make([]*Stop, 0)
-  stopList, ok := svc["stop"].([]interface{})
+  stopList, ok := utils.IfaceToSlice(svc["stop"])
   if !ok {
     return errors.New("Could not retrieve stop list from service route "+tag)
   }
@@ -187,6 +195,7 @@ func unmarshalServiceRoute(s *Service, v interface{}) error {
     }
   }
 
+  s.Stops = stops
   return nil
 }
 
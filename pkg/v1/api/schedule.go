@@ -0,0 +1,367 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/internal/utils"
+)
+
+// The weekdays each service class runs on, keyed by lower case class
+// name. Agencies mostly use "wkd", "sat" and "sun", classes they add
+// can be registered here.
+var ServiceClassDays = map[string][]time.Weekday{
+  "wkd": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+  "weekday": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+  "sat": {time.Saturday},
+  "saturday": {time.Saturday},
+  "sun": {time.Sunday},
+  "sunday": {time.Sunday},
+}
+
+// Schedule is the timetable of one direction of a route for one service
+// class, eg weekday trips towards downtown.
+type Schedule struct {
+  Route         *Route
+  // Identifies the timetable the schedule is taken from
+  ScheduleClass string
+  // The days the schedule runs on, see ServiceClassDays
+  ServiceClass  string
+  // The name of the direction, eg "Inbound"
+  Direction     string
+  // The timepoint stops each trip lists a time for. Other stops of
+  // the route are not scheduled.
+  Stops         []*ScheduleStop
+  Trips         []*ScheduledTrip
+}
+
+type ScheduleStop struct {
+  Tag   string
+  Title string
+}
+
+// ScheduledTrip is a single run along a schedule by one block.
+type ScheduledTrip struct {
+  BlockID string
+  // Milliseconds past the service date's midnight for each of the
+  // schedule's stops, -1 where the trip does not serve the stop. Trips
+  // running past midnight have times of 24 hours or more.
+  Times   []int64
+}
+
+// ScheduledDeparture is a trip's scheduled time at a stop on a given
+// service date.
+type ScheduledDeparture struct {
+  Schedule *Schedule
+  Trip     *ScheduledTrip
+  StopTag  string
+  Time     time.Time
+}
+
+// RunsOn reports whether the schedule's service class runs on the
+// weekday of the service date, the agency's calendar date at date.
+func (s *Schedule) RunsOn(date time.Time) bool {
+  weekday := date.In(s.location()).Weekday()
+  days := ServiceClassDays[strings.ToLower(s.ServiceClass)]
+  for _, d := range days {
+    if d == weekday {
+      return true
+    }
+  }
+
+  return false
+}
+
+// the location of the schedule's agency
+func (s *Schedule) location() *time.Location {
+  if s.Route == nil {
+    return time.Local
+  }
+
+  return s.Route.agency.location()
+}
+
+// index of the stop in the schedule header, -1 if it is not a timepoint
+func (s *Schedule) stopIndex(stopTag string) int {
+  for i, st := range s.Stops {
+    if st.Tag == stopTag {
+      return i
+    }
+  }
+
+  return -1
+}
+
+// ScheduleTime turns a time in milliseconds past midnight into a time on
+// the service date, in the location of date. The time is counted on the
+// wall clock, so it is right across DST changes. Schedule methods call
+// it with a service date in the agency's location.
+func ScheduleTime(date time.Time, ms int64) time.Time {
+  y, m, d := date.Date()
+  secs := int(ms / 1000)
+  nsec := int(ms % 1000) * int(time.Millisecond)
+
+  return time.Date(y, m, d, secs/3600, (secs/60)%60, secs%60, nsec, date.Location())
+}
+
+// Departures returns every trip scheduled at the stop on the service
+// date, in time order and in the agency's time zone. The service date
+// is the agency's calendar date at date. It is empty if the schedule
+// doesn't run on date.
+func (s *Schedule) Departures(stopTag string, date time.Time) []*ScheduledDeparture {
+  deps := make([]*ScheduledDeparture, 0)
+  loc := s.location()
+  date = date.In(loc)
+
+  idx := s.stopIndex(stopTag)
+  if idx < 0 || !s.RunsOn(date) {
+    return deps
+  }
+
+  y, m, d := date.Date()
+  date = time.Date(y, m, d, 0, 0, 0, 0, loc)
+
+  for _, trip := range s.Trips {
+    if idx >= len(trip.Times) || trip.Times[idx] < 0 {
+      continue
+    }
+
+    deps = append(deps, &ScheduledDeparture{
+      Schedule: s,
+      Trip: trip,
+      StopTag: stopTag,
+      Time: ScheduleTime(date, trip.Times[idx]),
+    })
+  }
+
+  sort.SliceStable(deps, func(i, j int) bool {
+    return deps[i].Time.Before(deps[j].Time)
+  })
+
+  return deps
+}
+
+// FirstTrip returns the first departure from the stop on the service
+// date, false if there is none.
+func (s *Schedule) FirstTrip(stopTag string, date time.Time) (*ScheduledDeparture, bool) {
+  deps := s.Departures(stopTag, date)
+  if len(deps) == 0 {
+    return nil, false
+  }
+
+  return deps[0], true
+}
+
+// LastTrip returns the last departure from the stop on the service
+// date, false if there is none.
+func (s *Schedule) LastTrip(stopTag string, date time.Time) (*ScheduledDeparture, bool) {
+  deps := s.Departures(stopTag, date)
+  if len(deps) == 0 {
+    return nil, false
+  }
+
+  return deps[len(deps)-1], true
+}
+
+func (r *Route) GetSchedules(opts...ApiHandlerOption) ([]*Schedule, error) {
+  return r.GetSchedulesContext(r.api.contextFor(opts), opts...)
+}
+
+// GetSchedulesContext fetches the timetables of the route, one for each
+// direction and service class.
+func (r *Route) GetSchedulesContext(ctx context.Context, opts...ApiHandlerOption) ([]*Schedule, error) {
+  aho := *DefaultApiHandlerOptions
+  for _, opt := range opts {
+    opt(&aho)
+  }
+
+  useCache := aho.UseCache
+  if r.schedules == nil || time.Now().Sub(r.scheduleAge) > r.api.cacheMaxAge {
+    useCache = false
+  }
+
+  if useCache {
+    r.api.cacheLookup(ctx, "schedules", true, slog.String("agency", r.agency.Tag), slog.String("route", r.Tag))
+    return r.schedules, nil
+  }
+  r.api.cacheLookup(ctx, "schedules", false, slog.String("agency", r.agency.Tag), slog.String("route", r.Tag))
+
+  iface, err := r.api.fetch(ctx, MethodSchedule(r.agency.Tag, r.Tag), PriorityBackground, aho.GetOpts...)
+  if err != nil {
+    if r.schedules != nil && r.api.serveStale(err) {
+      r.api.cacheLookup(ctx, "stale", true, slog.String("for", "schedules"), slog.String("agency", r.agency.Tag), slog.String("route", r.Tag))
+      return r.schedules, nil
+    }
+    return nil, err
+  }
+
+  schedules, err := r.unmarshalSchedules(iface)
+  if err != nil {
+    return nil, err
+  }
+
+  r.schedules = schedules
+  r.scheduleAge = time.Now()
+  return schedules, nil
+}
+
+// SchedulesOn returns the schedules of the route that run on the
+// service date, the agency's calendar date at date.
+func (r *Route) SchedulesOn(date time.Time, opts...ApiHandlerOption) ([]*Schedule, error) {
+  return r.SchedulesOnContext(r.api.contextFor(opts), date, opts...)
+}
+
+func (r *Route) SchedulesOnContext(ctx context.Context, date time.Time, opts...ApiHandlerOption) ([]*Schedule, error) {
+  schedules, err := r.GetSchedulesContext(ctx, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  out := make([]*Schedule, 0)
+  for _, s := range schedules {
+    if s.RunsOn(date) {
+      out = append(out, s)
+    }
+  }
+
+  return out, nil
+}
+
+// NextScheduledDepartures returns up to n scheduled departures from the
+// stop after the given time, in every direction, looking ahead as far as
+// a week. Only timepoint stops of the schedule have departures. Trips
+// of the previous service date that run past midnight are included.
+func (r *Route) NextScheduledDepartures(stop *Stop, after time.Time, n int, opts...ApiHandlerOption) ([]*ScheduledDeparture, error) {
+  return r.NextScheduledDeparturesContext(r.api.contextFor(opts), stop, after, n, opts...)
+}
+
+func (r *Route) NextScheduledDeparturesContext(ctx context.Context, stop *Stop, after time.Time, n int, opts...ApiHandlerOption) ([]*ScheduledDeparture, error) {
+  schedules, err := r.GetSchedulesContext(ctx, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  out := make([]*ScheduledDeparture, 0)
+  if n <= 0 {
+    return out, nil
+  }
+
+  // service dates are counted from the agency's midnight
+  loc := r.agency.location()
+  y, m, d := after.In(loc).Date()
+  for day := -1; day <= 7; day++ {
+    date := time.Date(y, m, d+day, 0, 0, 0, 0, loc)
+
+    // no trip of a later service date leaves before its midnight
+    if len(out) >= n && out[n-1].Time.Before(date) {
+      break
+    }
+
+    for _, s := range schedules {
+      for _, dep := range s.Departures(stop.Tag, date) {
+        if dep.Time.After(after) {
+          out = append(out, dep)
+        }
+      }
+    }
+
+    // late trips of one service date can overlap early trips of the
+    // next, so keep the lot in time order
+    sort.SliceStable(out, func(i, j int) bool {
+      return out[i].Time.Before(out[j].Time)
+    })
+  }
+
+  if len(out) > n {
+    out = out[:n]
+  }
+
+  return out, nil
+}
+
+func (r *Route) unmarshalSchedules(iface map[string]interface{}) ([]*Schedule, error) {
+  list, ok := utils.IfaceToSlice(iface["route"])
+  if !ok {
+    return nil, errors.New("Could not get schedules from response")
+  }
+
+  schedules := make([]*Schedule, 0, len(list))
+  for _, proto := range list {
+    sIface, ok := proto.(map[string]interface{})
+    if !ok {
+      return nil, errors.New("Could not unmarshal schedule to map[string]interface{}")
+    }
+
+    s := &Schedule{
+      Route: r,
+    }
+
+    s.ScheduleClass, _ = utils.IfaceToString(sIface["scheduleClass"])
+    s.ServiceClass, _ = utils.IfaceToString(sIface["serviceClass"])
+    s.Direction, _ = utils.IfaceToString(sIface["direction"])
+
+    header, ok := utils.IfaceToMap(sIface["header"])
+    if !ok {
+      return nil, errors.New("Could not get schedule header from response")
+    }
+
+    stops, _ := utils.IfaceToSlice(header["stop"])
+    for _, stopProto := range stops {
+      stop, ok := stopProto.(map[string]interface{})
+      if !ok {
+        continue
+      }
+
+      st := &ScheduleStop{}
+      st.Tag, _ = utils.IfaceToString(stop["tag"])
+      st.Title, _ = utils.IfaceToText(stop)
+      s.Stops = append(s.Stops, st)
+    }
+
+    trips, _ := utils.IfaceToSlice(sIface["tr"])
+    for _, tripProto := range trips {
+      tr, ok := tripProto.(map[string]interface{})
+      if !ok {
+        continue
+      }
+
+      trip := &ScheduledTrip{
+        Times: make([]int64, len(s.Stops)),
+      }
+      trip.BlockID, _ = utils.IfaceToString(tr["blockID"])
+      for i := range trip.Times {
+        trip.Times[i] = -1
+      }
+
+      // times are listed in header order, but fall back to the tag in
+      // case any are missing
+      times, _ := utils.IfaceToSlice(tr["stop"])
+      for i, timeProto := range times {
+        t, ok := timeProto.(map[string]interface{})
+        if !ok {
+          continue
+        }
+
+        tag, _ := utils.IfaceToString(t["tag"])
+        ms, ok := utils.IfaceToInt(t["epochTime"])
+        idx := i
+        if idx >= len(s.Stops) || s.Stops[idx].Tag != tag {
+          idx = s.stopIndex(tag)
+        }
+        if ok && idx >= 0 {
+          trip.Times[idx] = int64(ms)
+        }
+      }
+
+      s.Trips = append(s.Trips, trip)
+    }
+
+    schedules = append(schedules, s)
+  }
+
+  return schedules, nil
+}
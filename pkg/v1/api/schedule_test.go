@@ -0,0 +1,163 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+)
+
+const hour int64 = 3600*1000
+
+// Route L runs Sunday trips either side of 2am, when clocks change, and
+// a Saturday trip running past midnight into Sunday.
+func dstFeed() *apitest.Feed {
+  return &apitest.Feed{
+    Agencies: []*apitest.Agency{{
+      Tag: "sf-muni",
+      Title: "San Francisco Muni",
+      RegionTitle: "California-Northern",
+      Routes: []*apitest.Route{{
+        Tag: "L",
+        Title: "L-Taraval",
+        Stops: []*apitest.Stop{
+          {Tag: "taraval", StopID: "16666", Title: "Taraval St & 19th Ave", Lat: 37.7431, Lon: -122.4757},
+        },
+        Directions: []*apitest.Direction{
+          {Tag: "L__OB1", Title: "Outbound to Zoo", UseForUI: true, Stops: []string{"taraval"}},
+        },
+        Schedules: []*apitest.Schedule{
+          {
+            ScheduleClass: "2024T_FALL",
+            ServiceClass: "sun",
+            Direction: "Outbound",
+            Stops: []string{"taraval"},
+            Trips: []*apitest.Trip{
+              {BlockID: "9801", Times: []int64{hour/2}},
+              {BlockID: "9802", Times: []int64{hour + hour/2}},
+              {BlockID: "9803", Times: []int64{3*hour}},
+            },
+          },
+          {
+            ScheduleClass: "2024T_FALL",
+            ServiceClass: "sat",
+            Direction: "Outbound",
+            Stops: []string{"taraval"},
+            Trips: []*apitest.Trip{
+              {BlockID: "9901", Times: []int64{24*hour + hour*3/4}},
+            },
+          },
+        },
+      }},
+    }},
+  }
+}
+
+func dstRoute(t *testing.T) (*api.Route, []*api.Schedule) {
+  t.Helper()
+
+  srv := apitest.NewServer(dstFeed())
+  t.Cleanup(srv.Close)
+
+  agency := mustAgency(t, srv.ApiHandler())
+  route, err := agency.GetRoute("L")
+  if err != nil {
+    t.Fatal(err)
+  }
+  schedules, err := route.GetSchedules()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(schedules) != 2 {
+    t.Fatalf("got %d schedules, want 2", len(schedules))
+  }
+
+  return route, schedules
+}
+
+func formatDepartures(deps []*api.ScheduledDeparture) []string {
+  out := make([]string, 0)
+  for _, dep := range deps {
+    out = append(out, dep.Time.Format("Jan 2 15:04 MST"))
+  }
+
+  return out
+}
+
+func assertDepartures(t *testing.T, deps []*api.ScheduledDeparture, want ...string) {
+  t.Helper()
+
+  got := formatDepartures(deps)
+  if len(got) != len(want) {
+    t.Fatalf("got departures %v, want %v", got, want)
+  }
+  for i := range want {
+    if got[i] != want[i] {
+      t.Errorf("got departures %v, want %v", got, want)
+      return
+    }
+  }
+}
+
+// Times are counted on the wall clock, so trips after the change keep
+// their scheduled time and the hour skipped is not run.
+func TestDeparturesSpringForward(t *testing.T) {
+  route, schedules := dstRoute(t)
+  sunday := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+  sun, err := route.SchedulesOn(sunday)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(sun) != 1 || sun[0].ServiceClass != "sun" {
+    t.Fatalf("got %d schedules on Sunday", len(sun))
+  }
+
+  deps := sun[0].Departures("taraval", sunday)
+  assertDepartures(t, deps, "Mar 10 00:30 PST", "Mar 10 01:30 PST", "Mar 10 03:00 PDT")
+  if gap := deps[2].Time.Sub(deps[1].Time); gap != 30*time.Minute {
+    t.Errorf("got %v between 01:30 and 03:00, want 30m", gap)
+  }
+
+  // the Saturday trip past midnight is before the change
+  deps = schedules[1].Departures("taraval", time.Date(2024, time.March, 9, 0, 0, 0, 0, time.UTC).Add(20*time.Hour))
+  assertDepartures(t, deps, "Mar 10 00:45 PST")
+}
+
+func TestDeparturesFallBack(t *testing.T) {
+  _, schedules := dstRoute(t)
+  sunday := time.Date(2024, time.November, 3, 12, 0, 0, 0, time.UTC)
+
+  deps := schedules[0].Departures("taraval", sunday)
+  if len(deps) != 3 {
+    t.Fatalf("got departures %v", formatDepartures(deps))
+  }
+  if got := deps[0].Time.Format("Jan 2 15:04 MST"); got != "Nov 3 00:30 PDT" {
+    t.Errorf("got first departure %s", got)
+  }
+  if got := deps[2].Time.Format("Jan 2 15:04 MST"); got != "Nov 3 03:00 PST" {
+    t.Errorf("got last departure %s", got)
+  }
+  if gap := deps[2].Time.Sub(deps[0].Time); gap != 3*time.Hour + 30*time.Minute {
+    t.Errorf("got %v between 00:30 and 03:00, want 3h30m", gap)
+  }
+}
+
+// Departures after a UTC time late on Saturday evening, local time,
+// take in both the Saturday trip past midnight and the Sunday trips
+// across the change.
+func TestNextScheduledDeparturesAcrossChange(t *testing.T) {
+  route, _ := dstRoute(t)
+  stop, err := route.GetStopByTag("taraval")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  after := time.Date(2024, time.March, 10, 7, 0, 0, 0, time.UTC)
+  deps, err := route.NextScheduledDepartures(stop, after, 4)
+  if err != nil {
+    t.Fatal(err)
+  }
+  assertDepartures(t, deps, "Mar 10 00:30 PST", "Mar 10 00:45 PST", "Mar 10 01:30 PST", "Mar 10 03:00 PDT")
+}
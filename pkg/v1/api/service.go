@@ -1,5 +1,9 @@
 package api
 
+import (
+	"context"
+)
+
 // Referred to by the UmoIQ api as "direction", this is a route's 
 // service variant describing the order of stops the service uses, 
 // eg for a bus there may be North/South or East/West routes. These
@@ -17,3 +21,25 @@ type Service struct {
   agency        *Agency
   route         *Route
 }
+
+// GetPredictions fetches the predictions of the service (direction) at
+// one of its stops.
+func (s *Service) GetPredictions(stop *Stop, opts...ApiHandlerOption) ([]*Prediction, error) {
+  return s.GetPredictionsContext(s.api.contextFor(opts), stop, opts...)
+}
+
+func (s *Service) GetPredictionsContext(ctx context.Context, stop *Stop, opts...ApiHandlerOption) ([]*Prediction, error) {
+  preds, err := stop.GetRoutePredictionsContext(ctx, s.route.Tag, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  out := make([]*Prediction, 0)
+  for _, p := range preds {
+    if p.Service != nil && p.Service.Tag == s.Tag {
+      out = append(out, p)
+    }
+  }
+
+  return out, nil
+}
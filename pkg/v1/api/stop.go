@@ -1,11 +1,10 @@
 package api
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
+	"log/slog"
+	"sync"
 	"time"
-
-	"github.com/lcyvin/go-umoparse/internal/utils"
 )
 
 type Stop struct {
@@ -16,13 +15,40 @@ type Stop struct {
   Longitude     float64
   Latitude      float64
   Predictions   []*Prediction
+  // the last full predictions response, Predictions is taken from it
+  status        *StopPredictions
+  // predictions of a single route at the stop by route tag, and when
+  // they were fetched
   predictionMap map[string][]*Prediction
+  predictionAge map[string]time.Time
   cacheAge      time.Time
+  // guards Predictions and the prediction caches
+  mu            sync.Mutex
   api           *ApiHandler
   agency        *Agency
 }
 
 func (s *Stop) GetPredictions(opts...ApiHandlerOption) ([]*Prediction, error) {
+  return s.GetPredictionsContext(s.api.contextFor(opts), opts...)
+}
+
+func (s *Stop) GetPredictionsContext(ctx context.Context, opts...ApiHandlerOption) ([]*Prediction, error) {
+  sp, err := s.GetPredictionStatusContext(ctx, opts...)
+  if err != nil {
+    return nil, err
+  }
+
+  return sp.Predictions(), nil
+}
+
+// GetPredictionStatus fetches the predictions at the stop along with the
+// status of each route serving it, including why a route has none.
+// It shares its cache with GetPredictions.
+func (s *Stop) GetPredictionStatus(opts...ApiHandlerOption) (*StopPredictions, error) {
+  return s.GetPredictionStatusContext(s.api.contextFor(opts), opts...)
+}
+
+func (s *Stop) GetPredictionStatusContext(ctx context.Context, opts...ApiHandlerOption) (*StopPredictions, error) {
   aho := &ApiHandlerOptions{
     UseCache: true,
   }
@@ -37,13 +63,17 @@ func (s *Stop) GetPredictions(opts...ApiHandlerOption) ([]*Prediction, error) {
     cacheMaxAge = aho.CacheMaxAge
   }
 
+  s.mu.Lock()
+  cached, cacheAge := s.status, s.cacheAge
+  s.mu.Unlock()
+
   var useCache bool = true
 
-  if s.Predictions == nil {
+  if cached == nil {
     useCache = false
   }
 
-  if now.Sub(s.cacheAge) > (time.Duration(cacheMaxAge)*time.Second) {
+  if now.Sub(cacheAge) > (time.Duration(cacheMaxAge)*time.Second) {
     useCache = false
   }
 
@@ -52,69 +82,85 @@ func (s *Stop) GetPredictions(opts...ApiHandlerOption) ([]*Prediction, error) {
   }
 
   if useCache {
-    return s.Predictions, nil
+    s.api.cacheLookup(ctx, "predictions", true, slog.String("agency", s.agency.Tag), slog.String("stop", s.StopID))
+    return cached, nil
   }
+  s.api.cacheLookup(ctx, "predictions", false, slog.String("agency", s.agency.Tag), slog.String("stop", s.StopID))
 
-  data, err := s.predictionRequest("")
-  predictions := make([]*Prediction, 0)
-
-  pIface := make(map[string]interface{})
-  err = json.Unmarshal(data, &pIface)
+  pIface, err := s.predictionRequest(ctx, "", aho.GetOpts)
   if err != nil {
+    if cached != nil && s.api.serveStale(err) {
+      s.api.cacheLookup(ctx, "stale", true, slog.String("for", "predictions"), slog.String("agency", s.agency.Tag), slog.String("stop", s.StopID))
+      return cached, nil
+    }
     return nil, err
   }
 
-  // we need to test if there's only one object or an array returned,
-  // because UmoIQ doesn't maintain schema when there's only one
-  // item in a response
-  preds, ok := pIface["predictions"]
-  if !ok {
-    return nil, errors.New("PredictionUnmarshalErr")
+  sp, err := s.unmarshalStopPredictions(ctx, pIface)
+  if err != nil {
+    return nil, err
   }
 
-  predArray, ok := preds.([]interface{})
-  if !ok {
-    predSingle, ok := preds.(map[string]interface{})
-    if !ok {
-      return nil, errors.New("PredictionUnmarshalErr")
-    }
+  s.mu.Lock()
+  s.status = sp
+  s.Predictions = sp.Predictions()
+  s.cacheAge = now
+  s.mu.Unlock()
 
-    predArray = []interface{}{predSingle}
+  return sp, nil
+}
+
+// GetRoutePredictions fetches the predictions of a single route at the
+// stop. Stops without a public stopId are addressed by their tag.
+func (s *Stop) GetRoutePredictions(routeTag string, opts...ApiHandlerOption) ([]*Prediction, error) {
+  return s.GetRoutePredictionsContext(s.api.contextFor(opts), routeTag, opts...)
+}
+
+func (s *Stop) GetRoutePredictionsContext(ctx context.Context, routeTag string, opts...ApiHandlerOption) ([]*Prediction, error) {
+  aho := &ApiHandlerOptions{
+    UseCache: true,
   }
-  for _, routePreds := range predArray {
-    rp, ok := routePreds.(map[string]interface{})
-    if !ok {
-      return nil, errors.New("RoutePredictionUnmarshalErr")
-    }
 
-    _, emptyTest := utils.IfaceToString(rp["dirTitleBecauseNoPredictions"])
-    if emptyTest {
-      continue
-    }
+  for _, opt := range opts {
+    opt(aho)
+  }
 
+  now := time.Now()
+  cacheMaxAge := time.Duration(aho.CacheMaxAge)*time.Second
+  attrs := []slog.Attr{slog.String("agency", s.agency.Tag), slog.String("route", routeTag), slog.String("stop", s.Tag)}
 
-    svcPreds, ok := rp["direction"]
-    if !ok {
-      continue
-    }
-    
-    pset, err := unmarshalPredictionServiceRoutes(svcPreds, s)
-    if err != nil {
-      return nil, err
+  cached, age := s.cachedRoutePredictions(routeTag)
+  if aho.UseCache && cached != nil && now.Sub(age) <= cacheMaxAge {
+    s.api.cacheLookup(ctx, "predictions", true, attrs...)
+    return cached, nil
+  }
+  s.api.cacheLookup(ctx, "predictions", false, attrs...)
+
+  var pIface map[string]interface{}
+  var err error
+  if s.StopID != "" {
+    pIface, err = s.predictionRequest(ctx, routeTag, aho.GetOpts)
+  } else {
+    pIface, err = s.api.fetch(ctx, MethodPredictionsByTag(s.agency.Tag, routeTag, s.Tag), PriorityInteractive, aho.GetOpts...)
+  }
+  if err != nil {
+    if cached != nil && s.api.serveStale(err) {
+      s.api.cacheLookup(ctx, "stale", true, append(attrs, slog.String("for", "predictions"))...)
+      return cached, nil
     }
+    return nil, err
+  }
 
-    predictions = append(predictions, pset...)
+  sp, err := s.unmarshalStopPredictions(ctx, pIface)
+  if err != nil {
+    return nil, err
   }
 
-  s.Predictions = predictions
+  predictions := sp.Predictions()
+  s.cacheRoutePredictions(routeTag, predictions, now)
   return predictions, nil
 }
 
-func (s *Stop) predictionRequest(routeTag string) ([]byte, error) {
-  resp := s.api.Get(MethodPredictions(s.agency.Tag, s.StopID, routeTag))
-  if resp.Error() != nil {
-    return nil, resp.Error()
-  }
-
-  return resp.Data, nil
+func (s *Stop) predictionRequest(ctx context.Context, routeTag string, opts []GetOpt) (map[string]interface{}, error) {
+  return s.api.fetch(ctx, MethodPredictions(s.agency.Tag, s.StopID, routeTag), PriorityInteractive, opts...)
 }
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"time"
+)
+
+// IANA zones of agencies by tag, for agencies whose region is missing
+// from RegionTimezones, eg because it spans several zones. Entries may
+// be added or replaced before agencies are fetched, or set per handler
+// with WithAgencyLocation.
+var AgencyTimezones = map[string]string{
+  "sf-muni": "America/Los_Angeles",
+  "ttc": "America/Toronto",
+  "jtafla": "America/New_York",
+}
+
+// IANA zones by agency region title, used for agencies missing from
+// AgencyTimezones. Regions spanning several zones, eg "Florida", are
+// left out.
+var RegionTimezones = map[string]string{
+  "California-Northern": "America/Los_Angeles",
+  "California-Southern": "America/Los_Angeles",
+  "Nevada": "America/Los_Angeles",
+  "Oregon": "America/Los_Angeles",
+  "Washington": "America/Los_Angeles",
+  "Hawaii": "Pacific/Honolulu",
+  "Colorado": "America/Denver",
+  "Utah": "America/Denver",
+  "Ontario": "America/Toronto",
+  "Massachusetts": "America/New_York",
+  "Connecticut": "America/New_York",
+  "Rhode Island": "America/New_York",
+  "Maryland": "America/New_York",
+  "Delaware": "America/New_York",
+  "Virginia": "America/New_York",
+  "District of Columbia": "America/New_York",
+  "New Jersey": "America/New_York",
+  "New York": "America/New_York",
+  "North Carolina": "America/New_York",
+  "South Carolina": "America/New_York",
+  "Pennsylvania": "America/New_York",
+  "Ohio": "America/New_York",
+  "Georgia": "America/New_York",
+  "Iowa": "America/Chicago",
+  "Illinois": "America/Chicago",
+  "Minnesota": "America/Chicago",
+  "Wisconsin": "America/Chicago",
+  "Missouri": "America/Chicago",
+  "Louisiana": "America/Chicago",
+}
+
+// Sets the location of an agency for this handler, overriding
+// AgencyTimezones.
+func WithAgencyLocation(agencyTag string, loc *time.Location) ApiOption {
+  return func(a *ApiHandler) {
+    if a.locations == nil {
+      a.locations = make(map[string]*time.Location)
+    }
+    a.locations[agencyTag] = loc
+  }
+}
+
+// finds the location of an agency, nil if it isn't known or can't be
+// loaded, eg on a system without zoneinfo that doesn't import
+// time/tzdata.
+func (a *ApiHandler) agencyLocation(tag, region string) *time.Location {
+  loc, ok := a.locations[tag]
+  if ok && loc != nil {
+    return loc
+  }
+
+  name, ok := AgencyTimezones[tag]
+  if !ok {
+    name, ok = RegionTimezones[region]
+  }
+  if !ok {
+    return nil
+  }
+
+  loc, err := time.LoadLocation(name)
+  if err != nil {
+    return nil
+  }
+
+  return loc
+}
+
+// the agency's location, the local time zone if it isn't known
+func (a *Agency) location() *time.Location {
+  if a == nil || a.Location == nil {
+    return time.Local
+  }
+
+  return a.Location
+}
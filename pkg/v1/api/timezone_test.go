@@ -0,0 +1,53 @@
+package api_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+)
+
+func TestAgencyLocation(t *testing.T) {
+  srv := apitest.NewServer(&apitest.Feed{
+    Agencies: []*apitest.Agency{
+      {Tag: "sf-muni", Title: "San Francisco Muni", RegionTitle: "California-Northern"},
+      {Tag: "jtafla", Title: "Jacksonville Transportation Authority", RegionTitle: "Florida"},
+      {Tag: "pinellas", Title: "Pinellas Suncoast Transit", RegionTitle: "Florida"},
+    },
+  })
+  defer srv.Close()
+
+  var logs bytes.Buffer
+  h := srv.ApiHandler(api.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+  agencies, err := h.GetAgencies()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  want := map[string]string{
+    "sf-muni": "America/Los_Angeles",
+    "jtafla": "America/New_York",
+  }
+  for _, a := range agencies {
+    if a.Location == nil {
+      if want[a.Tag] != "" {
+        t.Errorf("%s: no location, want %s", a.Tag, want[a.Tag])
+      }
+      continue
+    }
+    if a.Location.String() != want[a.Tag] {
+      t.Errorf("%s: got location %s, want %q", a.Tag, a.Location, want[a.Tag])
+    }
+  }
+
+  // a region spanning zones isn't guessed at, and is logged
+  if !strings.Contains(logs.String(), "umoiq agency time zone unknown") || !strings.Contains(logs.String(), "agency=pinellas") {
+    t.Errorf("no warning for pinellas in\n%s", logs.String())
+  }
+  if strings.Contains(logs.String(), "agency=jtafla") {
+    t.Errorf("warned of jtafla in\n%s", logs.String())
+  }
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/internal/utils"
+)
+
+// How long a vehicle may go without reporting before it is dropped from
+// the fleet, eg after it has gone out of service
+const DefaultVehicleStaleAfter time.Duration = 5*time.Minute
+
+// Sets how long a vehicle may go without reporting its position before
+// GetVehicles stops returning it.
+func WithVehicleStaleAfter(d time.Duration) ApiOption {
+  return func(a *ApiHandler) {
+    a.vehicleStaleAfter = d
+  }
+}
+
+// Vehicle is the last reported position of a vehicle. Each report is a
+// new Vehicle, so values returned earlier are not changed by later polls.
+type Vehicle struct {
+  ID               string
+  RouteTag         string
+  // Tag of the direction (Service) the vehicle is serving, empty if it
+  // is not assigned to one
+  DirectionTag     string
+  Latitude         float64
+  Longitude        float64
+  // Degrees clockwise from north, negative if unknown
+  Heading          int
+  SpeedKmHr        float64
+  // Signals that the vehicle is used to make predictions
+  Predictable      bool
+  // Age of the position when it was fetched
+  SecsSinceReport  int
+  // The vehicle at the head of a multi-car consist, if this vehicle
+  // is one of the trailing cars
+  LeadingVehicleID string
+  // When the position was reported, per the feed's clock
+  ReportTime       time.Time
+  agency           *Agency
+}
+
+func (v *Vehicle) GetRoute() (*Route, error) {
+  return v.agency.GetRoute(v.RouteTag)
+}
+
+func (v *Vehicle) GetService() (*Service, error) {
+  if v.DirectionTag == "" {
+    return nil, errors.New("ServiceNotFoundErr")
+  }
+
+  return v.agency.GetServiceByRoute(v.RouteTag, v.DirectionTag)
+}
+
+// The positions known for an agency's vehicles, updated with each poll
+type fleet struct {
+  mu       sync.Mutex
+  vehicles map[string]*Vehicle
+  // feed time of the last poll for each route, "" for every route
+  lastTime map[string]int64
+}
+
+// the fleet state of an agency, shared by every Agency value with its tag
+func (a *ApiHandler) fleet(agency string) *fleet {
+  a.fleetsMu.Lock()
+  defer a.fleetsMu.Unlock()
+
+  if a.fleets == nil {
+    a.fleets = make(map[string]*fleet)
+  }
+
+  f, ok := a.fleets[agency]
+  if !ok {
+    f = &fleet{
+      vehicles: make(map[string]*Vehicle),
+      lastTime: make(map[string]int64),
+    }
+    a.fleets[agency] = f
+  }
+
+  return f
+}
+
+func (f *fleet) since(route string) int64 {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  return f.lastTime[route]
+}
+
+// merges reports into the fleet, keeping whichever position is newest
+func (f *fleet) merge(route string, lastTime int64, vehicles []*Vehicle) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  if lastTime > f.lastTime[route] {
+    f.lastTime[route] = lastTime
+  }
+
+  for _, v := range vehicles {
+    cur, ok := f.vehicles[v.ID]
+    if ok && cur.ReportTime.After(v.ReportTime) {
+      continue
+    }
+    f.vehicles[v.ID] = v
+  }
+}
+
+// drops vehicles that have not reported within staleAfter, and returns
+// the rest on the route, or on every route if route is empty
+func (f *fleet) current(route string, staleAfter time.Duration) []*Vehicle {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  now := time.Now()
+  vehicles := make([]*Vehicle, 0)
+  for id, v := range f.vehicles {
+    if staleAfter > 0 && now.Sub(v.ReportTime) > staleAfter {
+      delete(f.vehicles, id)
+      continue
+    }
+
+    if route == "" || v.RouteTag == route {
+      vehicles = append(vehicles, v)
+    }
+  }
+
+  sort.Slice(vehicles, func(i, j int) bool {
+    return vehicles[i].ID < vehicles[j].ID
+  })
+
+  return vehicles
+}
+
+// GetVehicles returns the vehicles on the route, or on every route if
+// routeTag is empty. Only positions reported since the previous call for
+// the same route are fetched, and merged into the fleet the handler
+// keeps for the agency. Vehicles that stop reporting are dropped.
+func (a *Agency) GetVehicles(routeTag string, opts...ApiHandlerOption) ([]*Vehicle, error) {
+  return a.GetVehiclesContext(a.api.contextFor(opts), routeTag, opts...)
+}
+
+func (a *Agency) GetVehiclesContext(ctx context.Context, routeTag string, opts...ApiHandlerOption) ([]*Vehicle, error) {
+  aho := *DefaultApiHandlerOptions
+  for _, opt := range opts {
+    opt(&aho)
+  }
+
+  f := a.api.fleet(a.Tag)
+  since := f.since(routeTag)
+
+  iface, err := a.api.fetch(ctx, MethodVehicleLocations(a.Tag, routeTag, strconv.FormatInt(since, 10)), PriorityInteractive, aho.GetOpts...)
+  if err != nil {
+    if a.api.serveStale(err) {
+      return f.current(routeTag, a.api.vehicleStaleAfter), nil
+    }
+    return nil, err
+  }
+
+  lastTime := time.Now().UnixMilli()
+  lt, ok := utils.IfaceToMap(iface["lastTime"])
+  if ok {
+    t, ok := utils.IfaceToInt(lt["time"])
+    if ok {
+      lastTime = int64(t)
+    }
+  }
+
+  vehicles, err := a.unmarshalVehicles(iface["vehicle"], lastTime)
+  if err != nil {
+    return nil, err
+  }
+
+  f.merge(routeTag, lastTime, vehicles)
+  return f.current(routeTag, a.api.vehicleStaleAfter), nil
+}
+
+// GetVehicle fetches the current position of a single vehicle.
+func (a *Agency) GetVehicle(vehicleId string, opts...ApiHandlerOption) (*Vehicle, error) {
+  return a.GetVehicleContext(a.api.contextFor(opts), vehicleId, opts...)
+}
+
+func (a *Agency) GetVehicleContext(ctx context.Context, vehicleId string, opts...ApiHandlerOption) (*Vehicle, error) {
+  aho := *DefaultApiHandlerOptions
+  for _, opt := range opts {
+    opt(&aho)
+  }
+
+  iface, err := a.api.fetch(ctx, MethodVehicleLocation(a.Tag, vehicleId), PriorityInteractive, aho.GetOpts...)
+  if err != nil {
+    return nil, err
+  }
+
+  vehicles, err := a.unmarshalVehicles(iface["vehicle"], time.Now().UnixMilli())
+  if err != nil {
+    return nil, err
+  }
+
+  if len(vehicles) == 0 {
+    return nil, errors.New("VehicleNotFoundErr")
+  }
+
+  a.api.fleet(a.Tag).merge("", 0, vehicles[:1])
+  return vehicles[0], nil
+}
+
+// GetVehicles returns the vehicles on the route, see Agency.GetVehicles.
+func (r *Route) GetVehicles(opts...ApiHandlerOption) ([]*Vehicle, error) {
+  return r.agency.GetVehicles(r.Tag, opts...)
+}
+
+func (r *Route) GetVehiclesContext(ctx context.Context, opts...ApiHandlerOption) ([]*Vehicle, error) {
+  return r.agency.GetVehiclesContext(ctx, r.Tag, opts...)
+}
+
+// lastTime is the feed's time in milliseconds when the response was
+// made, positions are reported relative to it
+func (a *Agency) unmarshalVehicles(v interface{}, lastTime int64) ([]*Vehicle, error) {
+  vehicles := make([]*Vehicle, 0)
+  if v == nil {
+    // nothing has reported since the last poll
+    return vehicles, nil
+  }
+
+  list, ok := utils.IfaceToSlice(v)
+  if !ok {
+    return nil, errors.New("Could not get vehicles from response")
+  }
+
+  for _, proto := range list {
+    vIface, ok := proto.(map[string]interface{})
+    if !ok {
+      return nil, errors.New("Could not unmarshal vehicle to map[string]interface{}")
+    }
+
+    veh := &Vehicle{
+      Heading: -1,
+      agency: a,
+    }
+
+    id, ok := utils.IfaceToString(vIface["id"])
+    if !ok {
+      return nil, errors.New("Could not get vehicle id from response")
+    }
+    veh.ID = id
+
+    veh.RouteTag, _ = utils.IfaceToString(vIface["routeTag"])
+    veh.DirectionTag, _ = utils.IfaceToString(vIface["dirTag"])
+    veh.Latitude, _ = utils.IfaceToFloat(vIface["lat"])
+    veh.Longitude, _ = utils.IfaceToFloat(vIface["lon"])
+    veh.SpeedKmHr, _ = utils.IfaceToFloat(vIface["speedKmHr"])
+    veh.Predictable, _ = utils.IfaceToBool(vIface["predictable"])
+    veh.LeadingVehicleID, _ = utils.IfaceToString(vIface["leadingVehicleId"])
+
+    heading, ok := utils.IfaceToInt(vIface["heading"])
+    if ok {
+      veh.Heading = heading
+    }
+
+    secs, ok := utils.IfaceToInt(vIface["secsSinceReport"])
+    if ok {
+      veh.SecsSinceReport = secs
+    }
+    veh.ReportTime = time.UnixMilli(lastTime).Add(-time.Duration(veh.SecsSinceReport)*time.Second).In(a.location())
+
+    vehicles = append(vehicles, veh)
+  }
+
+  return vehicles, nil
+}
@@ -0,0 +1,608 @@
+package apitest
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a request the feed refuses, answered with its error envelope
+type feedError struct {
+  msg         string
+  shouldRetry bool
+}
+
+func errorNode(e *feedError) *node {
+  n := newNode("Error", "shouldRetry", strconv.FormatBool(e.shouldRetry))
+  n.text = e.msg
+  return n
+}
+
+func invalidParam(param, value string) *feedError {
+  return &feedError{msg: fmt.Sprintf("%s parameter \"%s=%s\" is not valid.", paramTitle(param), param, value)}
+}
+
+func paramTitle(param string) string {
+  switch param {
+  case "a":
+    return "Agency"
+  case "r", "routeTag":
+    return "Route"
+  case "s", "stopId":
+    return "Stop"
+  }
+
+  return "The"
+}
+
+type command func(f *Feed, q url.Values, now time.Time) ([]*node, *feedError)
+
+var commands = map[string]command{
+  "agencyList": cmdAgencyList,
+  "routeList": cmdRouteList,
+  "routeConfig": cmdRouteConfig,
+  "predictions": cmdPredictions,
+  "predictionsForMultiStops": cmdPredictionsForMultiStops,
+  "schedule": cmdSchedule,
+  "vehicleLocations": cmdVehicleLocations,
+  "vehicleLocation": cmdVehicleLocation,
+  "messages": cmdMessages,
+}
+
+func requireAgency(f *Feed, q url.Values) (*Agency, *feedError) {
+  tag := q.Get("a")
+  if tag == "" {
+    return nil, &feedError{msg: "agency parameter \"a\" must be specified in query string"}
+  }
+
+  a := f.agency(tag)
+  if a == nil {
+    return nil, invalidParam("a", tag)
+  }
+
+  return a, nil
+}
+
+func requireRoute(a *Agency, q url.Values, param string) (*Route, *feedError) {
+  tag := q.Get(param)
+  if tag == "" {
+    return nil, &feedError{msg: "route parameter \""+param+"\" must be specified in query string"}
+  }
+
+  r := a.route(tag)
+  if r == nil {
+    return nil, invalidParam(param, tag)
+  }
+
+  return r, nil
+}
+
+func formatFloat(v float64) string {
+  return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatBool(b bool) string {
+  return strconv.FormatBool(b)
+}
+
+// only set on the response when true, as the feed does
+func trueOnly(b bool) string {
+  if b {
+    return "true"
+  }
+
+  return ""
+}
+
+func cmdAgencyList(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  nodes := make([]*node, 0, len(f.Agencies))
+  for _, a := range f.Agencies {
+    nodes = append(nodes, newNode("agency",
+      "tag", a.Tag,
+      "title", a.Title,
+      "shortTitle", a.ShortTitle,
+      "regionTitle", a.RegionTitle,
+    ))
+  }
+
+  return nodes, nil
+}
+
+func cmdRouteList(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  nodes := make([]*node, 0, len(a.Routes))
+  for _, r := range a.Routes {
+    nodes = append(nodes, newNode("route", "tag", r.Tag, "title", r.Title, "shortTitle", r.ShortTitle))
+  }
+
+  return nodes, nil
+}
+
+func cmdRouteConfig(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  routes := a.Routes
+  if q.Get("r") != "" {
+    r, ferr := requireRoute(a, q, "r")
+    if ferr != nil {
+      return nil, ferr
+    }
+    routes = []*Route{r}
+  }
+
+  nodes := make([]*node, 0, len(routes))
+  for _, r := range routes {
+    rn := newNode("route", "tag", r.Tag, "title", r.Title, "shortTitle", r.ShortTitle, "color", r.Color)
+    for _, s := range r.Stops {
+      rn.add(newNode("stop",
+        "tag", s.Tag,
+        "title", s.Title,
+        "shortTitle", s.ShortTitle,
+        "lat", formatFloat(s.Lat),
+        "lon", formatFloat(s.Lon),
+        "stopId", s.StopID,
+      ))
+    }
+
+    for _, d := range r.Directions {
+      dn := newNode("direction", "tag", d.Tag, "title", d.Title, "name", d.Name, "useForUI", formatBool(d.UseForUI))
+      for _, st := range d.Stops {
+        dn.add(newNode("stop", "tag", st))
+      }
+      rn.add(dn)
+    }
+
+    nodes = append(nodes, rn)
+  }
+
+  return nodes, nil
+}
+
+// the time of p relative to now
+func (p *Prediction) eta(now time.Time) time.Time {
+  if p.Eta.IsZero() {
+    return now.Add(time.Duration(p.Seconds)*time.Second)
+  }
+
+  return p.Eta
+}
+
+func predictionNode(p *Prediction, now time.Time) *node {
+  eta := p.eta(now)
+  secs := int64(eta.Sub(now) / time.Second)
+
+  n := newNode("prediction",
+    "epochTime", strconv.FormatInt(eta.UnixMilli(), 10),
+    "seconds", strconv.FormatInt(secs, 10),
+    "minutes", strconv.FormatInt(secs/60, 10),
+    "isDeparture", formatBool(p.IsDeparture),
+    "affectedByLayover", trueOnly(p.AffectedByLayover),
+    "isScheduleBased", trueOnly(p.ScheduleBased),
+    "delayed", trueOnly(p.Delayed),
+    "dirTag", p.Direction,
+    "vehicle", p.Vehicle,
+    "block", p.Block,
+    "tripTag", p.TripTag,
+    "branch", p.Branch,
+  )
+  if p.VehiclesInConsist > 0 {
+    n.set("vehiclesInConsist", strconv.Itoa(p.VehiclesInConsist))
+  }
+  if p.Slowness != 0 {
+    n.set("slowness", formatFloat(p.Slowness))
+  }
+
+  return n
+}
+
+// builds the predictions element for one route at one stop: predictions
+// grouped by direction, or dirTitleBecauseNoPredictions when there are
+// none, followed by any messages that apply
+func routePredictions(a *Agency, r *Route, s *Stop, now time.Time, shortTitles bool) *node {
+  routeTitle, stopTitle := r.Title, s.Title
+  if shortTitles && r.ShortTitle != "" {
+    routeTitle = r.ShortTitle
+  }
+  if shortTitles && s.ShortTitle != "" {
+    stopTitle = s.ShortTitle
+  }
+
+  pn := newNode("predictions",
+    "agencyTitle", a.Title,
+    "routeTitle", routeTitle,
+    "routeTag", r.Tag,
+    "stopTitle", stopTitle,
+    "stopTag", s.Tag,
+  )
+
+  preds := make([]*Prediction, 0)
+  for _, p := range a.Predictions {
+    if p.Route == r.Tag && p.Stop == s.Tag && !p.eta(now).Before(now) {
+      preds = append(preds, p)
+    }
+  }
+  sort.SliceStable(preds, func(i, j int) bool {
+    return preds[i].eta(now).Before(preds[j].eta(now))
+  })
+
+  if len(preds) == 0 {
+    pn.set("dirTitleBecauseNoPredictions", stopDirectionTitle(r, s))
+  }
+
+  dirNodes := make(map[string]*node)
+  for _, p := range preds {
+    title := p.Direction
+    d := r.direction(p.Direction)
+    if d != nil {
+      title = d.Title
+    }
+
+    dn, ok := dirNodes[title]
+    if !ok {
+      dn = newNode("direction", "title", title)
+      dirNodes[title] = dn
+      pn.add(dn)
+    }
+    dn.add(predictionNode(p, now))
+  }
+
+  for _, m := range a.Messages {
+    if m.Route == "" || m.Route == r.Tag {
+      if len(m.Stops) > 0 && !contains(m.Stops, s.Tag) {
+        continue
+      }
+      pn.add(newNode("message", "text", m.Text, "priority", messagePriority(m)))
+    }
+  }
+
+  return pn
+}
+
+// the title of the first direction of r that serves s
+func stopDirectionTitle(r *Route, s *Stop) string {
+  for _, d := range r.Directions {
+    if contains(d.Stops, s.Tag) {
+      return d.Title
+    }
+  }
+
+  return r.Title
+}
+
+func contains(list []string, v string) bool {
+  for _, s := range list {
+    if s == v {
+      return true
+    }
+  }
+
+  return false
+}
+
+func cmdPredictions(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+  shortTitles := q.Has("useShortTitles")
+
+  // stops may be addressed by route and stop tag
+  if q.Get("s") != "" {
+    r, ferr := requireRoute(a, q, "r")
+    if ferr != nil {
+      return nil, ferr
+    }
+
+    s := r.stop(q.Get("s"))
+    if s == nil {
+      return nil, invalidParam("s", q.Get("s"))
+    }
+
+    return []*node{routePredictions(a, r, s, now, shortTitles)}, nil
+  }
+
+  stopId := q.Get("stopId")
+  if stopId == "" {
+    return nil, &feedError{msg: "stop parameter \"stopId\" or \"s\" must be specified in query string"}
+  }
+
+  routeTag := q.Get("routeTag")
+  nodes := make([]*node, 0)
+  for _, r := range a.Routes {
+    if routeTag != "" && r.Tag != routeTag {
+      continue
+    }
+
+    for _, s := range r.Stops {
+      if s.StopID == stopId {
+        nodes = append(nodes, routePredictions(a, r, s, now, shortTitles))
+        break
+      }
+    }
+  }
+
+  if len(nodes) == 0 {
+    return nil, invalidParam("stopId", stopId)
+  }
+
+  return nodes, nil
+}
+
+func cmdPredictionsForMultiStops(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  stops := q["stops"]
+  if len(stops) == 0 {
+    return nil, &feedError{msg: "stops parameter \"stops\" must be specified in query string"}
+  }
+
+  nodes := make([]*node, 0, len(stops))
+  for _, pair := range stops {
+    routeTag, stopTag, ok := strings.Cut(pair, "|")
+    if !ok {
+      return nil, invalidParam("stops", pair)
+    }
+
+    r := a.route(routeTag)
+    if r == nil {
+      return nil, invalidParam("stops", pair)
+    }
+
+    s := r.stop(stopTag)
+    if s == nil {
+      return nil, invalidParam("stops", pair)
+    }
+
+    nodes = append(nodes, routePredictions(a, r, s, now, q.Has("useShortTitles")))
+  }
+
+  return nodes, nil
+}
+
+func formatScheduleTime(ms int64) string {
+  if ms < 0 {
+    return "--"
+  }
+
+  secs := ms / 1000
+  return fmt.Sprintf("%02d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+}
+
+func cmdSchedule(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  r, ferr := requireRoute(a, q, "r")
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  nodes := make([]*node, 0, len(r.Schedules))
+  for _, sch := range r.Schedules {
+    sn := newNode("route",
+      "tag", r.Tag,
+      "title", r.Title,
+      "scheduleClass", sch.ScheduleClass,
+      "serviceClass", sch.ServiceClass,
+      "direction", sch.Direction,
+    )
+
+    header := newNode("header")
+    for _, st := range sch.Stops {
+      hn := newNode("stop", "tag", st)
+      s := r.stop(st)
+      if s != nil {
+        hn.text = s.Title
+      }
+      header.add(hn)
+    }
+    sn.add(header)
+
+    for _, trip := range sch.Trips {
+      tn := newNode("tr", "blockID", trip.BlockID)
+      for i, st := range sch.Stops {
+        ms := int64(-1)
+        if i < len(trip.Times) {
+          ms = trip.Times[i]
+        }
+        stn := newNode("stop", "tag", st, "epochTime", strconv.FormatInt(ms, 10))
+        stn.text = formatScheduleTime(ms)
+        tn.add(stn)
+      }
+      sn.add(tn)
+    }
+
+    nodes = append(nodes, sn)
+  }
+
+  return nodes, nil
+}
+
+func vehicleNode(v *Vehicle) *node {
+  return newNode("vehicle",
+    "id", v.ID,
+    "routeTag", v.Route,
+    "dirTag", v.Direction,
+    "lat", formatFloat(v.Lat),
+    "lon", formatFloat(v.Lon),
+    "secsSinceReport", strconv.Itoa(v.SecsSinceReport),
+    "predictable", formatBool(v.Predictable),
+    "heading", strconv.Itoa(v.Heading),
+    "speedKmHr", formatFloat(v.SpeedKmHr),
+    "leadingVehicleId", v.LeadingVehicleID,
+  )
+}
+
+func cmdVehicleLocations(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  var since int64
+  if q.Get("t") != "" {
+    t, err := strconv.ParseInt(q.Get("t"), 10, 64)
+    if err != nil {
+      return nil, invalidParam("t", q.Get("t"))
+    }
+    since = t
+  }
+
+  routeTag := q.Get("r")
+  nodes := make([]*node, 0)
+  for _, v := range a.Vehicles {
+    if routeTag != "" && v.Route != routeTag {
+      continue
+    }
+
+    reported := now.Add(-time.Duration(v.SecsSinceReport)*time.Second)
+    if reported.UnixMilli() <= since {
+      continue
+    }
+
+    nodes = append(nodes, vehicleNode(v))
+  }
+
+  nodes = append(nodes, newNode("lastTime", "time", strconv.FormatInt(now.UnixMilli(), 10)))
+  return nodes, nil
+}
+
+func cmdVehicleLocation(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  for _, v := range a.Vehicles {
+    if v.ID == q.Get("v") {
+      return []*node{vehicleNode(v)}, nil
+    }
+  }
+
+  return nil, invalidParam("v", q.Get("v"))
+}
+
+func messagePriority(m *Message) string {
+  if m.Priority == "" {
+    return "Normal"
+  }
+
+  return m.Priority
+}
+
+func boundaryAttrs(n *node, prefix string, t time.Time) {
+  if t.IsZero() {
+    return
+  }
+
+  n.set(prefix, strconv.FormatInt(t.UnixMilli(), 10))
+  n.set(prefix+"Str", t.Format("Mon, Jan 02 03:04pm MST"))
+}
+
+func messageNode(m *Message) *node {
+  n := newNode("message",
+    "id", m.ID,
+    "sendToBuses", formatBool(m.SendToBuses),
+    "priority", messagePriority(m),
+  )
+  boundaryAttrs(n, "startBoundary", m.Start)
+  boundaryAttrs(n, "endBoundary", m.End)
+
+  if m.Route != "" && (len(m.Stops) > 0 || len(m.Directions) > 0) {
+    rc := newNode("routeConfiguredForMessage", "tag", m.Route)
+    for _, s := range m.Stops {
+      rc.add(newNode("stop", "tag", s))
+    }
+    for _, d := range m.Directions {
+      rc.add(newNode("direction", "tag", d))
+    }
+    n.add(rc)
+  }
+
+  text := newNode("text")
+  text.text = m.Text
+  n.add(text)
+
+  if m.SmsText != "" {
+    sms := newNode("smsText")
+    sms.text = m.SmsText
+    n.add(sms)
+  }
+
+  if m.PhonemeText != "" {
+    ph := newNode("phonemeText")
+    ph.text = m.PhonemeText
+    n.add(ph)
+  }
+
+  for _, i := range m.Intervals {
+    n.add(newNode("interval",
+      "startDay", strconv.Itoa(i.StartDay),
+      "startTime", strconv.Itoa(i.StartTime),
+      "endDay", strconv.Itoa(i.EndDay),
+      "endTime", strconv.Itoa(i.EndTime),
+    ))
+  }
+
+  return n
+}
+
+// messages are grouped under a route element, with agency-wide messages
+// under the route tag "all"
+func cmdMessages(f *Feed, q url.Values, now time.Time) ([]*node, *feedError) {
+  a, ferr := requireAgency(f, q)
+  if ferr != nil {
+    return nil, ferr
+  }
+
+  routes := q["r"]
+  for _, r := range routes {
+    if a.route(r) == nil {
+      return nil, invalidParam("r", r)
+    }
+  }
+
+  order := []string{"all"}
+  groups := map[string]*node{"all": newNode("route", "tag", "all")}
+  for _, m := range a.Messages {
+    tag := m.Route
+    if tag == "" {
+      tag = "all"
+    }
+    if tag != "all" && len(routes) > 0 && !contains(routes, tag) {
+      continue
+    }
+
+    g, ok := groups[tag]
+    if !ok {
+      g = newNode("route", "tag", tag)
+      groups[tag] = g
+      order = append(order, tag)
+    }
+    g.add(messageNode(m))
+  }
+
+  nodes := make([]*node, 0, len(order))
+  for _, tag := range order {
+    if len(groups[tag].children) > 0 {
+      nodes = append(nodes, groups[tag])
+    }
+  }
+
+  return nodes, nil
+}
@@ -0,0 +1,196 @@
+package apitest
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Feed is the data a Server answers requests from. It can be built in Go,
+// or loaded from a JSON fixture file with LoadFeed.
+type Feed struct {
+  Agencies  []*Agency `json:"agencies"`
+  // Sent as the copyright attribute of every response
+  Copyright string    `json:"copyright,omitempty"`
+}
+
+type Agency struct {
+  Tag         string        `json:"tag"`
+  Title       string        `json:"title"`
+  ShortTitle  string        `json:"shortTitle,omitempty"`
+  RegionTitle string        `json:"regionTitle,omitempty"`
+  Routes      []*Route      `json:"routes,omitempty"`
+  Predictions []*Prediction `json:"predictions,omitempty"`
+  Messages    []*Message    `json:"messages,omitempty"`
+  Vehicles    []*Vehicle    `json:"vehicles,omitempty"`
+}
+
+type Route struct {
+  Tag        string       `json:"tag"`
+  Title      string       `json:"title"`
+  ShortTitle string       `json:"shortTitle,omitempty"`
+  Color      string       `json:"color,omitempty"`
+  Stops      []*Stop      `json:"stops,omitempty"`
+  Directions []*Direction `json:"directions,omitempty"`
+  Schedules  []*Schedule  `json:"schedules,omitempty"`
+}
+
+type Stop struct {
+  Tag        string  `json:"tag"`
+  // The public stop id, stops without one can only be addressed by tag
+  StopID     string  `json:"stopId,omitempty"`
+  Title      string  `json:"title"`
+  ShortTitle string  `json:"shortTitle,omitempty"`
+  Lat        float64 `json:"lat"`
+  Lon        float64 `json:"lon"`
+}
+
+// Direction is a route's service variant, listing the tags of the stops
+// it serves in order.
+type Direction struct {
+  Tag      string   `json:"tag"`
+  Title    string   `json:"title"`
+  Name     string   `json:"name,omitempty"`
+  UseForUI bool     `json:"useForUI"`
+  Stops    []string `json:"stops"`
+}
+
+// Prediction is an arrival at a stop. Minutes and seconds are computed
+// against the server's clock when the prediction is served.
+type Prediction struct {
+  Route             string    `json:"route"`
+  Direction         string    `json:"direction"`
+  // Stop tag
+  Stop              string    `json:"stop"`
+  // When the vehicle arrives. If zero, Seconds is used instead.
+  Eta               time.Time `json:"eta,omitempty"`
+  // Seconds from the server's clock until the vehicle arrives
+  Seconds           int64     `json:"seconds,omitempty"`
+  Vehicle           string    `json:"vehicle,omitempty"`
+  Block             string    `json:"block,omitempty"`
+  TripTag           string    `json:"tripTag,omitempty"`
+  Branch            string    `json:"branch,omitempty"`
+  VehiclesInConsist int       `json:"vehiclesInConsist,omitempty"`
+  Slowness          float64   `json:"slowness,omitempty"`
+  IsDeparture       bool      `json:"isDeparture,omitempty"`
+  AffectedByLayover bool      `json:"affectedByLayover,omitempty"`
+  ScheduleBased     bool      `json:"scheduleBased,omitempty"`
+  Delayed           bool      `json:"delayed,omitempty"`
+}
+
+// Message is a service alert. With no Route it applies agency-wide; with
+// Stops or Directions it is limited to those parts of the route.
+type Message struct {
+  ID          string      `json:"id"`
+  Priority    string      `json:"priority,omitempty"`
+  Text        string      `json:"text"`
+  SmsText     string      `json:"smsText,omitempty"`
+  PhonemeText string      `json:"phonemeText,omitempty"`
+  SendToBuses bool        `json:"sendToBuses,omitempty"`
+  Start       time.Time   `json:"start,omitempty"`
+  End         time.Time   `json:"end,omitempty"`
+  Intervals   []*Interval `json:"intervals,omitempty"`
+  Route       string      `json:"route,omitempty"`
+  // Stop tags
+  Stops       []string    `json:"stops,omitempty"`
+  // Direction tags
+  Directions  []string    `json:"directions,omitempty"`
+}
+
+// Interval is a weekly recurring window in which a message is shown.
+// Days count from Sunday (0), times are seconds past midnight.
+type Interval struct {
+  StartDay  int `json:"startDay"`
+  StartTime int `json:"startTime"`
+  EndDay    int `json:"endDay"`
+  EndTime   int `json:"endTime"`
+}
+
+// Schedule is the timetable of one direction of a route for one
+// service class, eg weekday trips towards downtown.
+type Schedule struct {
+  ScheduleClass string   `json:"scheduleClass"`
+  ServiceClass  string   `json:"serviceClass"`
+  Direction     string   `json:"direction"`
+  // Tags of the timepoint stops each trip lists a time for
+  Stops         []string `json:"stops"`
+  Trips         []*Trip  `json:"trips"`
+}
+
+type Trip struct {
+  BlockID string  `json:"blockId"`
+  // Milliseconds past midnight for each of the schedule's stops, -1
+  // where the trip does not serve the stop
+  Times   []int64 `json:"times"`
+}
+
+// Vehicle is a live vehicle position.
+type Vehicle struct {
+  ID               string  `json:"id"`
+  Route            string  `json:"route"`
+  Direction        string  `json:"direction,omitempty"`
+  Lat              float64 `json:"lat"`
+  Lon              float64 `json:"lon"`
+  Heading          int     `json:"heading"`
+  SpeedKmHr        float64 `json:"speedKmHr"`
+  Predictable      bool    `json:"predictable"`
+  // Age of the position relative to the server's clock
+  SecsSinceReport  int     `json:"secsSinceReport"`
+  LeadingVehicleID string  `json:"leadingVehicleId,omitempty"`
+}
+
+// LoadFeed reads a Feed from a JSON fixture file.
+func LoadFeed(path string) (*Feed, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  f := &Feed{}
+  err = json.Unmarshal(data, f)
+  if err != nil {
+    return nil, err
+  }
+
+  return f, nil
+}
+
+func (f *Feed) agency(tag string) *Agency {
+  for _, a := range f.Agencies {
+    if a.Tag == tag {
+      return a
+    }
+  }
+
+  return nil
+}
+
+func (a *Agency) route(tag string) *Route {
+  for _, r := range a.Routes {
+    if r.Tag == tag {
+      return r
+    }
+  }
+
+  return nil
+}
+
+func (r *Route) stop(tag string) *Stop {
+  for _, s := range r.Stops {
+    if s.Tag == tag {
+      return s
+    }
+  }
+
+  return nil
+}
+
+func (r *Route) direction(tag string) *Direction {
+  for _, d := range r.Directions {
+    if d.Tag == tag {
+      return d
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,162 @@
+package apitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+)
+
+// node is a response element, rendered either as the JSON feed's object
+// layout or as the XML feed's elements.
+type node struct {
+  name     string
+  attrs    []attr
+  text     string
+  children []*node
+}
+
+type attr struct {
+  key, value string
+}
+
+func newNode(name string, attrs...string) *node {
+  n := &node{name: name}
+  for i := 0; i+1 < len(attrs); i += 2 {
+    n.set(attrs[i], attrs[i+1])
+  }
+
+  return n
+}
+
+// sets an attribute, empty values are left out as the feed does
+func (n *node) set(key, value string) *node {
+  if value != "" {
+    n.attrs = append(n.attrs, attr{key, value})
+  }
+
+  return n
+}
+
+func (n *node) add(children...*node) *node {
+  n.children = append(n.children, children...)
+  return n
+}
+
+// The JSON feed renders attributes as string properties and element
+// text as "content". Children are grouped by name, and a group with a
+// single child collapses from an array into a lone object. Children
+// holding only text collapse to a plain string.
+func renderJSON(n *node) []byte {
+  buf := &bytes.Buffer{}
+  writeJSONObject(buf, n)
+  return buf.Bytes()
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+  b, _ := json.Marshal(s)
+  buf.Write(b)
+}
+
+func writeJSONValue(buf *bytes.Buffer, n *node) {
+  if len(n.attrs) == 0 && len(n.children) == 0 {
+    writeJSONString(buf, n.text)
+    return
+  }
+
+  writeJSONObject(buf, n)
+}
+
+func writeJSONObject(buf *bytes.Buffer, n *node) {
+  buf.WriteByte('{')
+  first := true
+  sep := func() {
+    if !first {
+      buf.WriteByte(',')
+    }
+    first = false
+  }
+
+  for _, a := range n.attrs {
+    sep()
+    writeJSONString(buf, a.key)
+    buf.WriteByte(':')
+    writeJSONString(buf, a.value)
+  }
+
+  if n.text != "" {
+    sep()
+    buf.WriteString(`"content":`)
+    writeJSONString(buf, n.text)
+  }
+
+  order := make([]string, 0)
+  groups := make(map[string][]*node)
+  for _, c := range n.children {
+    _, ok := groups[c.name]
+    if !ok {
+      order = append(order, c.name)
+    }
+    groups[c.name] = append(groups[c.name], c)
+  }
+
+  for _, name := range order {
+    sep()
+    writeJSONString(buf, name)
+    buf.WriteByte(':')
+
+    group := groups[name]
+    if len(group) == 1 {
+      writeJSONValue(buf, group[0])
+      continue
+    }
+
+    buf.WriteByte('[')
+    for i, c := range group {
+      if i > 0 {
+        buf.WriteByte(',')
+      }
+      writeJSONValue(buf, c)
+    }
+    buf.WriteByte(']')
+  }
+
+  buf.WriteByte('}')
+}
+
+// The XML feed keeps every child as its own element, so lists never
+// change shape.
+func renderXML(n *node) []byte {
+  buf := &bytes.Buffer{}
+  buf.WriteString(xml.Header)
+  writeXMLElement(buf, n)
+  return buf.Bytes()
+}
+
+func writeXMLElement(buf *bytes.Buffer, n *node) {
+  buf.WriteByte('<')
+  buf.WriteString(n.name)
+  for _, a := range n.attrs {
+    buf.WriteByte(' ')
+    buf.WriteString(a.key)
+    buf.WriteString(`="`)
+    xml.EscapeText(buf, []byte(a.value))
+    buf.WriteByte('"')
+  }
+
+  if n.text == "" && len(n.children) == 0 {
+    buf.WriteString("/>\n")
+    return
+  }
+
+  buf.WriteByte('>')
+  xml.EscapeText(buf, []byte(n.text))
+  if len(n.children) > 0 {
+    buf.WriteByte('\n')
+  }
+  for _, c := range n.children {
+    writeXMLElement(buf, c)
+  }
+  buf.WriteString("</")
+  buf.WriteString(n.name)
+  buf.WriteString(">\n")
+}
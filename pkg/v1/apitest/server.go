@@ -0,0 +1,215 @@
+// Package apitest provides a fake UmoIQ feed server for tests. It speaks
+// the publicJSONFeed and publicXMLFeed protocols, answering from a Feed
+// built in Go or loaded from a fixture file, and reproduces the feed's
+// quirks: single item arrays collapsing into lone objects,
+// dirTitleBecauseNoPredictions, and error envelopes.
+//
+//   srv := apitest.NewServer(feed)
+//   defer srv.Close()
+//   h := srv.ApiHandler()
+//   agency, err := h.GetAgency("sf-muni")
+package apitest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+)
+
+const defaultCopyright string = "All data copyright agencies listed below and apitest."
+
+// Fault makes the server fail requests for a command.
+type Fault struct {
+  // Respond with the feed's error envelope carrying this message
+  Message     string
+  ShouldRetry bool
+  // Respond with this HTTP status and an HTML body instead, if set
+  Status      int
+  // Sent as a Retry-After header, in whole seconds, with Status
+  RetryAfter  time.Duration
+  // Number of requests to fail, 0 to fail every request until the
+  // fault is cleared
+  Times       int
+}
+
+type Server struct {
+  *httptest.Server
+  mu       sync.Mutex
+  feed     *Feed
+  now      func() time.Time
+  faults   map[string]*Fault
+  requests map[string]int
+}
+
+type Option func(*Server)
+
+// Sets the clock predictions, vehicle reports and lastTime are computed
+// against, by default time.Now.
+func WithClock(now func() time.Time) Option {
+  return func(s *Server) {
+    s.now = now
+  }
+}
+
+// NewServer starts a server answering from feed. The feed must not be
+// modified while the server runs, except through Update.
+func NewServer(feed *Feed, opts...Option) *Server {
+  s := &Server{
+    feed: feed,
+    now: time.Now,
+    faults: make(map[string]*Fault),
+    requests: make(map[string]int),
+  }
+
+  for _, opt := range opts {
+    opt(s)
+  }
+
+  s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+  return s
+}
+
+// NewServerFromFile starts a server answering from a JSON fixture file,
+// see LoadFeed.
+func NewServerFromFile(path string, opts...Option) (*Server, error) {
+  feed, err := LoadFeed(path)
+  if err != nil {
+    return nil, err
+  }
+
+  return NewServer(feed, opts...), nil
+}
+
+// Update runs fn with the server's feed while no request is being served,
+// eg to add predictions or move vehicles between polls.
+func (s *Server) Update(fn func(f *Feed)) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  fn(s.feed)
+}
+
+// Fault makes requests for command fail as described by f.
+func (s *Server) Fault(command string, f Fault) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.faults[command] = &f
+}
+
+func (s *Server) ClearFaults() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.faults = make(map[string]*Fault)
+}
+
+// Requests reports how many requests were made for command.
+func (s *Server) Requests(command string) int {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return s.requests[command]
+}
+
+// ApiHandler returns a handler pointed at this server, with client side
+// rate limiting disabled. Further options are applied after these.
+func (s *Server) ApiHandler(opts...api.ApiOption) *api.ApiHandler {
+  base := []api.ApiOption{
+    api.WithBaseURL(s.URL),
+    api.WithHttpClient(s.Client()),
+    api.WithoutRateLimit(),
+  }
+
+  return api.NewApiHandler(&api.GetConfig{
+    Timeout: 10*time.Second,
+    RetryDelay: 50*time.Millisecond,
+    Context: context.Background(),
+  }, append(base, opts...)...)
+}
+
+// returns the fault to apply to a request for command, if any. Must
+// hold mu.
+func (s *Server) takeFault(command string) *Fault {
+  f, ok := s.faults[command]
+  if !ok {
+    return nil
+  }
+
+  if f.Times > 0 {
+    f.Times--
+    if f.Times == 0 {
+      delete(s.faults, command)
+    }
+  }
+
+  return f
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+  var render func(*node) []byte
+  switch path.Base(r.URL.Path) {
+  case "publicJSONFeed":
+    render = renderJSON
+    w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+  case "publicXMLFeed":
+    render = renderXML
+    w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+  default:
+    http.NotFound(w, r)
+    return
+  }
+
+  q := r.URL.Query()
+  cmd := q.Get("command")
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.requests[cmd]++
+
+  copyright := s.feed.Copyright
+  if copyright == "" {
+    copyright = defaultCopyright
+  }
+  body := newNode("body", "copyright", copyright)
+
+  fault := s.takeFault(cmd)
+  if fault != nil && fault.Status != 0 {
+    w.Header().Set("Content-Type", "text/html")
+    if fault.RetryAfter > 0 {
+      w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter/time.Second)))
+    }
+    w.WriteHeader(fault.Status)
+    w.Write([]byte("<html><body><h1>" + http.StatusText(fault.Status) + "</h1></body></html>"))
+    return
+  }
+
+  if fault != nil {
+    body.add(errorNode(&feedError{msg: fault.Message, shouldRetry: fault.ShouldRetry}))
+    w.Write(render(body))
+    return
+  }
+
+  handler, ok := commands[cmd]
+  if !ok {
+    body.add(errorNode(&feedError{msg: "Command \"" + cmd + "\" is not valid."}))
+    w.Write(render(body))
+    return
+  }
+
+  nodes, ferr := handler(s.feed, q, s.now())
+  if ferr != nil {
+    body.add(errorNode(ferr))
+  } else {
+    body.add(nodes...)
+  }
+
+  w.Write(render(body))
+}
@@ -0,0 +1,376 @@
+package apitest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+)
+
+var backends = []api.Backend{api.JSONBackend, api.XMLBackend}
+
+func newFixtureServer(t *testing.T, opts...apitest.Option) *apitest.Server {
+  t.Helper()
+
+  srv, err := apitest.NewServerFromFile("testdata/sf-muni.json", opts...)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(srv.Close)
+
+  return srv
+}
+
+// requests a feed directly, without an ApiHandler
+func rawGet(t *testing.T, srv *apitest.Server, feed, query string) (int, string) {
+  t.Helper()
+
+  resp, err := srv.Client().Get(srv.URL+"/"+feed+"?"+query)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer resp.Body.Close()
+
+  body, err := io.ReadAll(resp.Body)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return resp.StatusCode, string(body)
+}
+
+func rawJSON(t *testing.T, srv *apitest.Server, query string) map[string]interface{} {
+  t.Helper()
+
+  _, body := rawGet(t, srv, "publicJSONFeed", query)
+  v := make(map[string]interface{})
+  err := json.Unmarshal([]byte(body), &v)
+  if err != nil {
+    t.Fatalf("%v in %s", err, body)
+  }
+
+  return v
+}
+
+func TestJSONCollapsesSingleItems(t *testing.T) {
+  srv := newFixtureServer(t)
+
+  // one agency and one stop collapse to objects, two routes stay a list
+  agencies := rawJSON(t, srv, "command=agencyList")
+  _, ok := agencies["agency"].(map[string]interface{})
+  if !ok {
+    t.Errorf("single agency rendered as %T, want an object", agencies["agency"])
+  }
+
+  routes := rawJSON(t, srv, "command=routeList&a=sf-muni")
+  list, ok := routes["route"].([]interface{})
+  if !ok || len(list) != 2 {
+    t.Errorf("two routes rendered as %T, want a list of 2", routes["route"])
+  }
+
+  cfg := rawJSON(t, srv, "command=routeConfig&a=sf-muni&r=J")
+  route, _ := cfg["route"].(map[string]interface{})
+  _, ok = route["stop"].(map[string]interface{})
+  if !ok {
+    t.Errorf("single stop rendered as %T, want an object", route["stop"])
+  }
+
+  // the XML feed never collapses
+  _, body := rawGet(t, srv, "publicXMLFeed", "command=routeConfig&a=sf-muni&r=J")
+  if strings.Count(body, "<stop ") != 2 {
+    t.Errorf("routeConfig XML missing stop elements:\n%s", body)
+  }
+}
+
+func TestErrorEnvelope(t *testing.T) {
+  srv := newFixtureServer(t)
+
+  v := rawJSON(t, srv, "command=routeList&a=nope")
+  e, ok := v["Error"].(map[string]interface{})
+  if !ok {
+    t.Fatalf("no Error object in %v", v)
+  }
+  if e["content"] != `Agency parameter "a=nope" is not valid.` || e["shouldRetry"] != "false" {
+    t.Errorf("got error %v", e)
+  }
+
+  _, body := rawGet(t, srv, "publicXMLFeed", "command=routeList&a=nope")
+  want := `<Error shouldRetry="false">Agency parameter &#34;a=nope&#34; is not valid.</Error>`
+  if !strings.Contains(body, want) {
+    t.Errorf("XML error missing %s:\n%s", want, body)
+  }
+
+  for _, b := range backends {
+    h := srv.ApiHandler(api.WithBackend(b))
+    resp := h.Get(api.MethodRoutes("nope"))
+
+    var fe *api.FeedError
+    if !errors.As(resp.Error(), &fe) {
+      t.Fatalf("%s: got %v, want a FeedError", b.FeedPath(), resp.Error())
+    }
+    if fe.Command != "routeList" || fe.Message != `Agency parameter "a=nope" is not valid.` {
+      t.Errorf("%s: got %+v", b.FeedPath(), fe)
+    }
+  }
+}
+
+func TestNoPredictions(t *testing.T) {
+  srv := newFixtureServer(t)
+
+  v := rawJSON(t, srv, "command=predictions&a=sf-muni&stopId=14006")
+  p, _ := v["predictions"].(map[string]interface{})
+  if p["dirTitleBecauseNoPredictions"] != "Outbound to Balboa Park" {
+    t.Errorf("got predictions %v", p)
+  }
+  _, ok := p["direction"]
+  if ok {
+    t.Errorf("route without predictions has directions: %v", p)
+  }
+
+  for _, b := range backends {
+    agency, err := srv.ApiHandler(api.WithBackend(b)).GetAgency("sf-muni")
+    if err != nil {
+      t.Fatal(err)
+    }
+    stop, err := agency.GetStop("14006")
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    sp, err := stop.GetPredictionStatus()
+    if err != nil {
+      t.Fatal(err)
+    }
+    rp, ok := sp.Route("J")
+    if !ok || rp.Status != api.NoPredictions || rp.DirectionTitle != "Outbound to Balboa Park" {
+      t.Errorf("%s: got %+v", b.FeedPath(), rp)
+    }
+  }
+}
+
+func TestHandlerEndToEnd(t *testing.T) {
+  for _, b := range backends {
+    t.Run(b.FeedPath(), func(t *testing.T) {
+      srv := newFixtureServer(t)
+      h := srv.ApiHandler(api.WithBackend(b))
+
+      agency, err := h.GetAgency("sf-muni")
+      if err != nil {
+        t.Fatal(err)
+      }
+      if agency.Title != "San Francisco Muni" || agency.Location.String() != "America/Los_Angeles" {
+        t.Errorf("got agency %q in %s", agency.Title, agency.Location)
+      }
+
+      routes, err := agency.GetRoutes()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(routes) != 2 {
+        t.Fatalf("got %d routes, want 2", len(routes))
+      }
+
+      stop, err := agency.GetStop("15240")
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      preds, err := stop.GetPredictions()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(preds) != 2 || preds[0].VehicleID != "1501" || preds[0].Seconds != 125 || !preds[1].ScheduleBased {
+        t.Errorf("got %d predictions", len(preds))
+      }
+
+      sp, err := stop.GetPredictionStatus()
+      if err != nil {
+        t.Fatal(err)
+      }
+      rp, _ := sp.Route("N")
+      if rp == nil || rp.Status != api.PredictionsLive || len(rp.Messages) != 1 {
+        t.Errorf("got route status %+v", rp)
+      }
+
+      // the route's message is scoped to another stop
+      msgs, err := stop.GetMessages()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(msgs) != 1 || msgs[0].Text != "Fares are changing on January 1" || !msgs[0].AgencyWide() {
+        t.Errorf("got %d messages at stop 5240", len(msgs))
+      }
+
+      byRoute, err := agency.GetMessages("N")
+      if err != nil {
+        t.Fatal(err)
+      }
+      withOpts, err := agency.GetMessagesWithOptions([]string{"N"}, api.WithGetOpts(api.WithRetryLimit(1)))
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(byRoute) != 2 || len(withOpts) != 2 {
+        t.Errorf("got %d and %d messages for route N, want 2", len(byRoute), len(withOpts))
+      }
+
+      n, err := agency.GetRoute("N")
+      if err != nil {
+        t.Fatal(err)
+      }
+      schedules, err := n.GetSchedules()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(schedules) != 1 || len(schedules[0].Trips) != 2 || schedules[0].Stops[1].Title != "Judah St & 9th Ave" {
+        t.Fatalf("got %d schedules", len(schedules))
+      }
+
+      monday := time.Date(2024, time.March, 4, 0, 0, 0, 0, agency.Location)
+      deps := schedules[0].Departures("judah", monday)
+      if len(deps) != 1 || deps[0].Time.Format("15:04") != "06:05" {
+        t.Errorf("got %d departures from judah", len(deps))
+      }
+
+      vehicles, err := agency.GetVehicles("")
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(vehicles) != 2 || vehicles[0].ID != "1410" || vehicles[1].Heading != 265 {
+        t.Errorf("got %d vehicles", len(vehicles))
+      }
+    })
+  }
+}
+
+// A UTC time just before local midnight is on the agency's service date,
+// not the UTC one.
+func TestDeparturesServiceDate(t *testing.T) {
+  srv := newFixtureServer(t)
+
+  agency, err := srv.ApiHandler().GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+  n, err := agency.GetRoute("N")
+  if err != nil {
+    t.Fatal(err)
+  }
+  schedules, err := n.GetSchedules()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // Saturday in UTC, Friday evening in San Francisco
+  date := time.Date(2024, time.March, 9, 5, 0, 0, 0, time.UTC)
+  running, err := n.SchedulesOn(date)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(running) != 1 || running[0].ServiceClass != "wkd" {
+    t.Fatalf("got %d schedules running, want the weekday one", len(running))
+  }
+
+  deps := schedules[0].Departures("judah", date)
+  if len(deps) != 1 {
+    t.Fatalf("got %d departures from judah, want the weekday one", len(deps))
+  }
+  if got := deps[0].Time.Format("Mon Jan 2 15:04 MST"); got != "Fri Mar 8 06:05 PST" {
+    t.Errorf("got departure at %s", got)
+  }
+}
+
+// Vehicle polls after the first only return positions reported since
+// the last one, which are merged with those already known.
+func TestVehiclePolling(t *testing.T) {
+  now := time.Now().Truncate(time.Second)
+  srv := newFixtureServer(t, apitest.WithClock(func() time.Time { return now }))
+  h := srv.ApiHandler()
+
+  agency, err := h.GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = agency.GetVehicles("")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  srv.Update(func(f *apitest.Feed) {
+    now = now.Add(15*time.Second)
+    v := f.Agencies[0].Vehicles[0]
+    v.Lat = 37.7622
+    v.SecsSinceReport = 5
+  })
+
+  vehicles, err := agency.GetVehicles("")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(vehicles) != 2 {
+    t.Fatalf("got %d vehicles, want both", len(vehicles))
+  }
+  for _, v := range vehicles {
+    if v.ID == "1501" && v.Latitude != 37.7622 {
+      t.Errorf("vehicle 1501 not moved, at %v", v.Latitude)
+    }
+  }
+}
+
+func TestFaults(t *testing.T) {
+  srv := newFixtureServer(t)
+  h := srv.ApiHandler()
+
+  // an outage answered with an HTML error page, once
+  srv.Fault("agencyList", apitest.Fault{Status: http.StatusServiceUnavailable, Times: 1})
+  status, body := rawGet(t, srv, "publicJSONFeed", "command=agencyList")
+  if status != http.StatusServiceUnavailable || !strings.Contains(body, "<html>") {
+    t.Errorf("got %d %s", status, body)
+  }
+  status, _ = rawGet(t, srv, "publicJSONFeed", "command=agencyList")
+  if status != http.StatusOK {
+    t.Errorf("fault not cleared after one request, got %d", status)
+  }
+
+  // the handler retries through a single failure
+  srv.Fault("routeList", apitest.Fault{Status: http.StatusServiceUnavailable, Times: 1})
+  resp := h.Get(api.MethodRoutes("sf-muni"), api.WithRetryLimit(2))
+  if resp.Error() != nil {
+    t.Fatal(resp.Error())
+  }
+  if n := srv.Requests("routeList"); n != 2 {
+    t.Errorf("feed got %d routeList requests, want 2", n)
+  }
+
+  // a feed error carries shouldRetry
+  srv.Fault("routeConfig", apitest.Fault{Message: "Feed is overloaded", ShouldRetry: true})
+  resp = h.Get(api.MethodRouteConfig("sf-muni", "N"))
+  var fe *api.FeedError
+  if !errors.As(resp.Error(), &fe) || !fe.ShouldRetry || fe.Message != "Feed is overloaded" {
+    t.Errorf("got %v, want a retryable FeedError", resp.Error())
+  }
+
+  srv.ClearFaults()
+  resp = h.Get(api.MethodRouteConfig("sf-muni", "N"))
+  if resp.Error() != nil {
+    t.Errorf("fault not cleared: %v", resp.Error())
+  }
+}
+
+func TestUnknownCommand(t *testing.T) {
+  srv := newFixtureServer(t)
+
+  for _, b := range backends {
+    resp := srv.ApiHandler(api.WithBackend(b)).Get(api.NewApiMethod("bogus"))
+    var fe *api.FeedError
+    if !errors.As(resp.Error(), &fe) || fe.Message != `Command "bogus" is not valid.` {
+      t.Errorf("%s: got %v", b.FeedPath(), resp.Error())
+    }
+  }
+}
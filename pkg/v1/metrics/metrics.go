@@ -0,0 +1,266 @@
+// Package metrics exports the activity of an api.ApiHandler in the
+// Prometheus text exposition format, using only the standard library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+)
+
+// Default histogram buckets for request latency, in seconds
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+// Default histogram buckets for rate limiter waits, in seconds
+var DefaultWaitBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 20}
+
+// Collector implements api.Observer, and serves the metrics it has
+// collected over HTTP. Use it with api.WithObserver:
+//
+//   c := metrics.New()
+//   h := api.NewApiHandler(cfg, api.WithObserver(c))
+//   http.Handle("/metrics", c)
+type Collector struct {
+  mu             sync.Mutex
+  requests       map[labels]float64
+  latency        map[labels]*histogram
+  bytes          map[labels]float64
+  wire           map[labels]float64
+  retries        map[labels]float64
+  cache          map[labels]float64
+  wait           *histogram
+  latencyBuckets []float64
+}
+
+var _ api.Observer = (*Collector)(nil)
+
+type CollectorOption func(*Collector)
+
+func WithLatencyBuckets(buckets []float64) CollectorOption {
+  return func(c *Collector) {
+    c.latencyBuckets = buckets
+  }
+}
+
+func WithWaitBuckets(buckets []float64) CollectorOption {
+  return func(c *Collector) {
+    c.wait = newHistogram(buckets)
+  }
+}
+
+func New(opts...CollectorOption) *Collector {
+  c := &Collector{
+    requests: make(map[labels]float64),
+    latency: make(map[labels]*histogram),
+    bytes: make(map[labels]float64),
+    wire: make(map[labels]float64),
+    retries: make(map[labels]float64),
+    cache: make(map[labels]float64),
+    wait: newHistogram(DefaultWaitBuckets),
+    latencyBuckets: DefaultLatencyBuckets,
+  }
+
+  for _, opt := range opts {
+    opt(c)
+  }
+
+  return c
+}
+
+func (c *Collector) ObserveRequest(e api.RequestEvent) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.requests[labels{"command", e.Command, "outcome", e.Outcome}]++
+  c.bytes[labels{"command", e.Command, "", ""}] += float64(e.Bytes)
+  c.wire[labels{"command", e.Command, "", ""}] += float64(e.WireBytes)
+
+  key := labels{"command", e.Command, "", ""}
+  h, ok := c.latency[key]
+  if !ok {
+    h = newHistogram(c.latencyBuckets)
+    c.latency[key] = h
+  }
+  h.observe(e.Latency.Seconds())
+}
+
+func (c *Collector) ObserveRetry(command string, class api.RetryClass) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.retries[labels{"command", command, "reason", class.String()}]++
+}
+
+func (c *Collector) ObserveCache(layer string, hit bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  result := "miss"
+  if hit {
+    result = "hit"
+  }
+  c.cache[labels{"layer", layer, "result", result}]++
+}
+
+func (c *Collector) ObserveRateLimitWait(d time.Duration) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.wait.observe(d.Seconds())
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  cw := &countWriter{w: bufio.NewWriter(w)}
+  writeCounter(cw, "umoiq_requests_total", "Feed requests by command and final outcome.", c.requests)
+  writeHistograms(cw, "umoiq_request_duration_seconds", "Feed request latency including retries.", c.latency)
+  writeCounter(cw, "umoiq_response_bytes_total", "Response body bytes received from the feed, after decompression.", c.bytes)
+  writeCounter(cw, "umoiq_response_wire_bytes_total", "Response bytes received on the wire, before decompression.", c.wire)
+  writeCounter(cw, "umoiq_retries_total", "Retried feed request attempts by command and reason.", c.retries)
+  writeCounter(cw, "umoiq_cache_lookups_total", "Cache lookups by layer and result.", c.cache)
+  writeHistograms(cw, "umoiq_rate_limit_wait_seconds", "Time spent waiting on the client rate limiter.", map[labels]*histogram{{}: c.wait})
+
+  if cw.err != nil {
+    return cw.n, cw.err
+  }
+
+  err := cw.w.Flush()
+  return cw.n, err
+}
+
+// ServeHTTP writes the current metrics, so the Collector can be mounted
+// directly as a scrape endpoint.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  c.WriteTo(w)
+}
+
+// up to two label pairs, unused pairs are left empty
+type labels struct {
+  k1, v1, k2, v2 string
+}
+
+func (l labels) String() string {
+  pairs := make([]string, 0, 2)
+  if l.k1 != "" {
+    pairs = append(pairs, l.k1+"=\""+escapeLabel(l.v1)+"\"")
+  }
+  if l.k2 != "" {
+    pairs = append(pairs, l.k2+"=\""+escapeLabel(l.v2)+"\"")
+  }
+
+  return strings.Join(pairs, ",")
+}
+
+// adds an extra label pair to the rendered labels
+func (l labels) with(k, v string) string {
+  s := l.String()
+  if s != "" {
+    s += ","
+  }
+
+  return s + k + "=\"" + escapeLabel(v) + "\""
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(v string) string {
+  return labelEscaper.Replace(v)
+}
+
+type histogram struct {
+  buckets []float64
+  counts  []uint64
+  sum     float64
+  count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+  b := append([]float64(nil), buckets...)
+  sort.Float64s(b)
+
+  return &histogram{
+    buckets: b,
+    counts: make([]uint64, len(b)),
+  }
+}
+
+func (h *histogram) observe(v float64) {
+  for i, b := range h.buckets {
+    if v <= b {
+      h.counts[i]++
+    }
+  }
+  h.sum += v
+  h.count++
+}
+
+type countWriter struct {
+  w   *bufio.Writer
+  n   int64
+  err error
+}
+
+func (cw *countWriter) printf(format string, args...interface{}) {
+  if cw.err != nil {
+    return
+  }
+
+  n, err := fmt.Fprintf(cw.w, format, args...)
+  cw.n += int64(n)
+  cw.err = err
+}
+
+func sortedLabels[T any](m map[labels]T) []labels {
+  keys := make([]labels, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    return keys[i].String() < keys[j].String()
+  })
+
+  return keys
+}
+
+func formatFloat(v float64) string {
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func series(name string, l string) string {
+  if l == "" {
+    return name
+  }
+
+  return name + "{" + l + "}"
+}
+
+func writeCounter(cw *countWriter, name, help string, values map[labels]float64) {
+  cw.printf("# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+  for _, l := range sortedLabels(values) {
+    cw.printf("%s %s\n", series(name, l.String()), formatFloat(values[l]))
+  }
+}
+
+func writeHistograms(cw *countWriter, name, help string, values map[labels]*histogram) {
+  cw.printf("# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+  for _, l := range sortedLabels(values) {
+    h := values[l]
+    for i, b := range h.buckets {
+      cw.printf("%s %d\n", series(name+"_bucket", l.with("le", formatFloat(b))), h.counts[i])
+    }
+    cw.printf("%s %d\n", series(name+"_bucket", l.with("le", "+Inf")), h.count)
+    cw.printf("%s %s\n", series(name+"_sum", l.String()), formatFloat(h.sum))
+    cw.printf("%s %d\n", series(name+"_count", l.String()), h.count)
+  }
+}
@@ -0,0 +1,78 @@
+package metrics_test
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/metrics"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// a collector that has seen a few of each kind of event, with a command
+// name needing escaping
+func observed() *metrics.Collector {
+  c := metrics.New(
+    metrics.WithLatencyBuckets([]float64{1, 0.1}),
+    metrics.WithWaitBuckets([]float64{0.5, 0.01}),
+  )
+
+  c.ObserveRequest(api.RequestEvent{Command: "routeConfig", Outcome: api.OutcomeSuccess, Attempts: 1, Latency: 50*time.Millisecond, Bytes: 1000, WireBytes: 300})
+  c.ObserveRequest(api.RequestEvent{Command: "routeConfig", Outcome: api.OutcomeSuccess, Attempts: 2, Latency: 2*time.Second, Bytes: 500, WireBytes: 200})
+  c.ObserveRequest(api.RequestEvent{Command: "odd\"cmd\\\n", Outcome: api.OutcomeHTTPError, Attempts: 1, Latency: 500*time.Millisecond})
+  c.ObserveRetry("routeConfig", api.RetryServerError)
+  c.ObserveCache("routes", true)
+  c.ObserveCache("routes", false)
+  c.ObserveCache("routes", true)
+  c.ObserveRateLimitWait(0)
+  c.ObserveRateLimitWait(200*time.Millisecond)
+  c.ObserveRateLimitWait(3*time.Second)
+
+  return c
+}
+
+func TestWriteTo(t *testing.T) {
+  var buf bytes.Buffer
+  n, err := observed().WriteTo(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if n != int64(buf.Len()) {
+    t.Errorf("reported %d bytes written, wrote %d", n, buf.Len())
+  }
+
+  golden := "testdata/metrics.txt"
+  if *update {
+    err := os.WriteFile(golden, buf.Bytes(), 0644)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  want, err := os.ReadFile(golden)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if buf.String() != string(want) {
+    t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+  }
+}
+
+func TestServeHTTP(t *testing.T) {
+  rec := httptest.NewRecorder()
+  observed().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+  if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+    t.Errorf("got content type %q", ct)
+  }
+  if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `umoiq_cache_lookups_total{layer="routes",result="hit"} 2`) {
+    t.Errorf("got %d\n%s", rec.Code, rec.Body.String())
+  }
+}
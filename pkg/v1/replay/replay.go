@@ -0,0 +1,296 @@
+// Package replay provides an http.RoundTripper that records feed
+// responses to a cassette directory and serves them back later, so that
+// code using an api.ApiHandler can be tested without network access.
+//
+//   rt := replay.New("testdata/cassettes", replay.ModeReplay)
+//   h := api.NewApiHandler(cfg, api.WithHttpClient(rt.Client()))
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type Mode int
+
+const (
+  // serve responses from the cassette directory, failing requests that
+  // have no cassette
+  ModeReplay Mode = iota
+  // send every request to the feed and save its response
+  ModeRecord
+  // replay requests that have a cassette, and record the rest
+  ModeReplayOrRecord
+)
+
+// MissingCassetteError is returned in replay mode for requests that were
+// never recorded.
+type MissingCassetteError struct {
+  Key string
+}
+
+func (e *MissingCassetteError) Error() string {
+  return "no cassette recorded for " + e.Key
+}
+
+// Transport records and replays feed responses.
+type Transport struct {
+  dir          string
+  mode         Mode
+  next         http.RoundTripper
+  now          func() time.Time
+  rewriteTimes bool
+}
+
+type Option func(*Transport)
+
+// Sets the transport used to reach the feed when recording, by default
+// http.DefaultTransport.
+func WithTransport(rt http.RoundTripper) Option {
+  return func(t *Transport) {
+    t.next = rt
+  }
+}
+
+// Sets the clock that replayed prediction times are rewritten against,
+// by default time.Now.
+func WithClock(now func() time.Time) Option {
+  return func(t *Transport) {
+    t.now = now
+  }
+}
+
+// Rewrites predictions when they are replayed, shifting each epochTime
+// by the time passed since the cassette was recorded and recomputing
+// minutes and seconds against the replay clock. Without this, bodies are
+// replayed byte-for-byte.
+func WithTimeRewrite() Option {
+  return func(t *Transport) {
+    t.rewriteTimes = true
+  }
+}
+
+func New(dir string, mode Mode, opts...Option) *Transport {
+  t := &Transport{
+    dir: dir,
+    mode: mode,
+    next: http.DefaultTransport,
+    now: time.Now,
+  }
+
+  for _, opt := range opts {
+    opt(t)
+  }
+
+  return t
+}
+
+// Returns a client using this transport, for use with api.WithHttpClient.
+func (t *Transport) Client() *http.Client {
+  return &http.Client{Transport: t}
+}
+
+// a recorded response. The body is stored next to it, byte-for-byte.
+type cassette struct {
+  Key        string      `json:"key"`
+  Command    string      `json:"command"`
+  Status     int         `json:"status"`
+  Header     http.Header `json:"header"`
+  RecordedAt time.Time   `json:"recordedAt"`
+}
+
+// Key returns the cassette key for a request: the feed it was made to
+// followed by its query parameters in canonical order.
+func Key(req *http.Request) string {
+  q := req.URL.Query()
+  return path.Base(req.URL.Path) + "?" + q.Encode()
+}
+
+// the cassette file for a key, without extension
+func (t *Transport) file(req *http.Request, key string) string {
+  sum := sha1.Sum([]byte(key))
+  name := req.URL.Query().Get("command")
+  if name == "" {
+    name = "request"
+  }
+
+  return filepath.Join(t.dir, name+"-"+hex.EncodeToString(sum[:8]))
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+  key := Key(req)
+  file := t.file(req, key)
+
+  if t.mode != ModeRecord {
+    resp, err := t.replay(req, key, file)
+    if err == nil || t.mode == ModeReplay {
+      return resp, err
+    }
+    var mce *MissingCassetteError
+    if !errors.As(err, &mce) {
+      return nil, err
+    }
+  }
+
+  return t.record(req, key, file)
+}
+
+func (t *Transport) record(req *http.Request, key, file string) (*http.Response, error) {
+  resp, err := t.next.RoundTrip(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  body, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return nil, err
+  }
+
+  c := &cassette{
+    Key: key,
+    Command: req.URL.Query().Get("command"),
+    Status: resp.StatusCode,
+    Header: resp.Header,
+    RecordedAt: t.now(),
+  }
+
+  meta, err := json.MarshalIndent(c, "", "  ")
+  if err != nil {
+    return nil, err
+  }
+
+  err = os.MkdirAll(t.dir, 0o755)
+  if err != nil {
+    return nil, err
+  }
+
+  err = os.WriteFile(file+".json", meta, 0o644)
+  if err != nil {
+    return nil, err
+  }
+
+  err = os.WriteFile(file+".body", body, 0o644)
+  if err != nil {
+    return nil, err
+  }
+
+  resp.Body = io.NopCloser(bytes.NewReader(body))
+  return resp, nil
+}
+
+func (t *Transport) replay(req *http.Request, key, file string) (*http.Response, error) {
+  meta, err := os.ReadFile(file+".json")
+  if os.IsNotExist(err) {
+    return nil, &MissingCassetteError{Key: key}
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  c := &cassette{}
+  err = json.Unmarshal(meta, c)
+  if err != nil {
+    return nil, fmt.Errorf("could not read cassette %s: %w", file, err)
+  }
+
+  body, err := os.ReadFile(file+".body")
+  if err != nil {
+    return nil, err
+  }
+
+  header := c.Header.Clone()
+  if header == nil {
+    header = make(http.Header)
+  }
+
+  if t.rewriteTimes && isPredictionCommand(c.Command) {
+    if header.Get("Content-Encoding") == "gzip" {
+      body, err = gunzip(body)
+      if err != nil {
+        return nil, err
+      }
+      header.Del("Content-Encoding")
+    }
+    body = rewritePredictionTimes(body, t.now(), t.now().Sub(c.RecordedAt))
+  }
+  header.Set("Content-Length", strconv.Itoa(len(body)))
+
+  return &http.Response{
+    Status: fmt.Sprintf("%d %s", c.Status, http.StatusText(c.Status)),
+    StatusCode: c.Status,
+    Proto: "HTTP/1.1",
+    ProtoMajor: 1,
+    ProtoMinor: 1,
+    Header: header,
+    Body: io.NopCloser(bytes.NewReader(body)),
+    ContentLength: int64(len(body)),
+    Request: req,
+  }, nil
+}
+
+func isPredictionCommand(cmd string) bool {
+  return cmd == "predictions" || cmd == "predictionsForMultiStops"
+}
+
+func gunzip(data []byte) ([]byte, error) {
+  zr, err := gzip.NewReader(bytes.NewReader(data))
+  if err != nil {
+    return nil, err
+  }
+  defer zr.Close()
+
+  return io.ReadAll(zr)
+}
+
+// a single prediction, as a flat JSON object or an XML element
+var predictionRe = regexp.MustCompile(`\{[^{}]*"epochTime"[^{}]*\}|<prediction\b[^>]*>`)
+var epochRe = regexp.MustCompile(`("epochTime"\s*:\s*"?|epochTime=")(\d+)`)
+var minutesRe = regexp.MustCompile(`("minutes"\s*:\s*"?|minutes=")(-?\d+)`)
+var secondsRe = regexp.MustCompile(`("seconds"\s*:\s*"?|seconds=")(-?\d+)`)
+
+// shifts every prediction's epochTime by offset, and sets its minutes
+// and seconds to the time remaining from now
+func rewritePredictionTimes(body []byte, now time.Time, offset time.Duration) []byte {
+  return predictionRe.ReplaceAllFunc(body, func(pred []byte) []byte {
+    m := epochRe.FindSubmatch(pred)
+    if m == nil {
+      return pred
+    }
+
+    epoch, err := strconv.ParseInt(string(m[2]), 10, 64)
+    if err != nil {
+      return pred
+    }
+
+    eta := time.UnixMilli(epoch).Add(offset)
+    secs := int64(eta.Sub(now) / time.Second)
+
+    pred = replaceNumber(epochRe, pred, eta.UnixMilli())
+    pred = replaceNumber(secondsRe, pred, secs)
+    pred = replaceNumber(minutesRe, pred, secs/60)
+    return pred
+  })
+}
+
+func replaceNumber(re *regexp.Regexp, b []byte, v int64) []byte {
+  return re.ReplaceAllFunc(b, func(match []byte) []byte {
+    m := re.FindSubmatch(match)
+    return append(append([]byte{}, m[1]...), strconv.FormatInt(v, 10)...)
+  })
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
@@ -0,0 +1,300 @@
+package replay_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lcyvin/go-umoparse/pkg/v1/api"
+	"github.com/lcyvin/go-umoparse/pkg/v1/apitest"
+	"github.com/lcyvin/go-umoparse/pkg/v1/replay"
+)
+
+var recordClock = time.Date(2024, time.March, 5, 17, 0, 0, 0, time.UTC)
+
+func testFeed() *apitest.Feed {
+  return &apitest.Feed{
+    Agencies: []*apitest.Agency{{
+      Tag: "sf-muni",
+      Title: "San Francisco Muni",
+      RegionTitle: "California-Northern",
+      Routes: []*apitest.Route{{
+        Tag: "N",
+        Title: "N-Judah",
+        Stops: []*apitest.Stop{
+          {Tag: "5240", StopID: "15240", Title: "Carl St & Cole St", Lat: 37.7656, Lon: -122.4497},
+          {Tag: "judah", StopID: "14448", Title: "Judah St & 9th Ave", Lat: 37.7622, Lon: -122.4663},
+        },
+        Directions: []*apitest.Direction{
+          {Tag: "N__OB1", Title: "Outbound to Ocean Beach", UseForUI: true, Stops: []string{"5240", "judah"}},
+        },
+      }},
+      Predictions: []*apitest.Prediction{
+        {Route: "N", Direction: "N__OB1", Stop: "5240", Seconds: 125, Vehicle: "1501"},
+        {Route: "N", Direction: "N__OB1", Stop: "5240", Seconds: 845, Vehicle: "1520"},
+      },
+    }},
+  }
+}
+
+// a handler reaching baseURL through rt
+func newHandler(baseURL string, rt *replay.Transport, opts...api.ApiOption) *api.ApiHandler {
+  base := []api.ApiOption{
+    api.WithBaseURL(baseURL),
+    api.WithHttpClient(rt.Client()),
+    api.WithoutRateLimit(),
+  }
+
+  return api.NewApiHandler(&api.GetConfig{
+    Timeout: 10*time.Second,
+    RetryDelay: 50*time.Millisecond,
+    Context: context.Background(),
+  }, append(base, opts...)...)
+}
+
+// fetches the agency, its routes and the predictions at a stop, as text
+func fetchAll(t *testing.T, h *api.ApiHandler) string {
+  t.Helper()
+
+  agency, err := h.GetAgency("sf-muni")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  routes, err := agency.GetRoutes()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  stop, err := agency.GetStop("15240")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  preds, err := stop.GetPredictions()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var b strings.Builder
+  fmt.Fprintf(&b, "agency %s %s\n", agency.Tag, agency.Title)
+  for _, r := range routes {
+    fmt.Fprintf(&b, "route %s %s %d stops %d services\n", r.Tag, r.Title, len(r.Stops), len(r.Services))
+  }
+  for _, p := range preds {
+    fmt.Fprintf(&b, "prediction %s %s %d %s\n", p.Service.Tag, p.Eta.UTC().Format(time.RFC3339), p.Seconds, p.VehicleID)
+  }
+
+  return b.String()
+}
+
+// compresses responses when the request asks for gzip, as the real feed
+// does
+type gzipTransport struct {
+  next http.RoundTripper
+}
+
+func (g gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+  resp, err := g.next.RoundTrip(req)
+  if err != nil || !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+    return resp, err
+  }
+  defer resp.Body.Close()
+
+  body, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return nil, err
+  }
+
+  var buf bytes.Buffer
+  zw := gzip.NewWriter(&buf)
+  zw.Write(body)
+  zw.Close()
+
+  resp.Header.Set("Content-Encoding", "gzip")
+  resp.Header.Del("Content-Length")
+  resp.ContentLength = int64(buf.Len())
+  resp.Body = io.NopCloser(&buf)
+  return resp, nil
+}
+
+func TestRecordThenReplay(t *testing.T) {
+  for _, b := range []api.Backend{api.JSONBackend, api.XMLBackend} {
+    t.Run(b.FeedPath(), func(t *testing.T) {
+      dir := t.TempDir()
+      srv := apitest.NewServer(testFeed(), apitest.WithClock(func() time.Time { return recordClock }))
+      baseURL := srv.URL
+
+      rec := replay.New(dir, replay.ModeRecord, replay.WithTransport(srv.Client().Transport))
+      recorded := fetchAll(t, newHandler(baseURL, rec, api.WithBackend(b)))
+      srv.Close()
+
+      files, err := filepath.Glob(filepath.Join(dir, "*.body"))
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(files) == 0 {
+        t.Fatal("no cassettes were recorded")
+      }
+
+      // the server is gone, so everything must come from the cassettes
+      replayed := fetchAll(t, newHandler(baseURL, replay.New(dir, replay.ModeReplay), api.WithBackend(b)))
+
+      if replayed != recorded {
+        t.Errorf("replayed\n%s\nrecorded\n%s", replayed, recorded)
+      }
+    })
+  }
+}
+
+func TestReplayGzip(t *testing.T) {
+  dir := t.TempDir()
+  srv := apitest.NewServer(testFeed(), apitest.WithClock(func() time.Time { return recordClock }))
+  baseURL := srv.URL
+
+  rec := replay.New(dir, replay.ModeRecord,
+    replay.WithTransport(gzipTransport{next: srv.Client().Transport}),
+    replay.WithClock(func() time.Time { return recordClock }),
+  )
+  recorded := fetchAll(t, newHandler(baseURL, rec))
+  srv.Close()
+
+  files, err := filepath.Glob(filepath.Join(dir, "predictions-*.body"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(files) != 1 {
+    t.Fatalf("got %d predictions cassettes, want 1", len(files))
+  }
+  body, err := os.ReadFile(files[0])
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+    t.Errorf("cassette body was not stored compressed")
+  }
+
+  replayed := fetchAll(t, newHandler(baseURL, replay.New(dir, replay.ModeReplay)))
+  if replayed != recorded {
+    t.Errorf("replayed\n%s\nrecorded\n%s", replayed, recorded)
+  }
+
+  // rewriting has to decompress the body first
+  rewrite := replay.New(dir, replay.ModeReplay,
+    replay.WithTimeRewrite(),
+    replay.WithClock(func() time.Time { return recordClock.Add(time.Hour) }),
+  )
+  rewritten := fetchAll(t, newHandler(baseURL, rewrite))
+  want := "prediction N__OB1 2024-03-05T18:02:05Z 125 1501\n"
+  if !strings.Contains(rewritten, want) {
+    t.Errorf("rewritten predictions missing %q:\n%s", want, rewritten)
+  }
+}
+
+func TestReplayMissingCassette(t *testing.T) {
+  rt := replay.New(t.TempDir(), replay.ModeReplay)
+
+  req, err := http.NewRequest(http.MethodGet, "http://feed.invalid/publicJSONFeed?command=agencyList", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = rt.RoundTrip(req)
+  var mce *replay.MissingCassetteError
+  if !errors.As(err, &mce) {
+    t.Fatalf("got %v, want a MissingCassetteError", err)
+  }
+  if mce.Key != "publicJSONFeed?command=agencyList" {
+    t.Errorf("got key %q", mce.Key)
+  }
+
+  // and through a handler, wrapped in its transport error
+  _, err = newHandler("http://feed.invalid", rt).GetAgency("sf-muni")
+  if !errors.As(err, &mce) {
+    t.Fatalf("got %v, want a MissingCassetteError", err)
+  }
+}
+
+func TestReplayOrRecord(t *testing.T) {
+  dir := t.TempDir()
+  srv := apitest.NewServer(testFeed())
+  defer srv.Close()
+
+  rt := replay.New(dir, replay.ModeReplayOrRecord, replay.WithTransport(srv.Client().Transport))
+  for i := 0; i < 2; i++ {
+    _, err := newHandler(srv.URL, rt).GetAgency("sf-muni")
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  if n := srv.Requests("agencyList"); n != 1 {
+    t.Errorf("feed got %d agencyList requests, want 1", n)
+  }
+}
+
+func TestTimeRewrite(t *testing.T) {
+  dir := t.TempDir()
+  srv := apitest.NewServer(testFeed(), apitest.WithClock(func() time.Time { return recordClock }))
+  baseURL := srv.URL
+
+  rec := replay.New(dir, replay.ModeRecord,
+    replay.WithTransport(srv.Client().Transport),
+    replay.WithClock(func() time.Time { return recordClock }),
+  )
+  fetchAll(t, newHandler(baseURL, rec))
+  srv.Close()
+
+  later := recordClock.Add(90*time.Minute)
+
+  // by default bodies are replayed as recorded
+  plain := fetchAll(t, newHandler(baseURL, replay.New(dir, replay.ModeReplay, replay.WithClock(func() time.Time { return later }))))
+  want := "prediction N__OB1 2024-03-05T17:02:05Z 125 1501\n"
+  if !strings.Contains(plain, want) {
+    t.Errorf("replayed predictions missing %q:\n%s", want, plain)
+  }
+
+  // with a rewrite, predictions move along with the clock
+  rewritten := fetchAll(t, newHandler(baseURL, replay.New(dir, replay.ModeReplay,
+    replay.WithTimeRewrite(),
+    replay.WithClock(func() time.Time { return later }),
+  )))
+  for _, want := range []string{
+    "prediction N__OB1 2024-03-05T18:32:05Z 125 1501\n",
+    "prediction N__OB1 2024-03-05T18:44:05Z 845 1520\n",
+  } {
+    if !strings.Contains(rewritten, want) {
+      t.Errorf("rewritten predictions missing %q:\n%s", want, rewritten)
+    }
+  }
+}
+
+// The cassette key of a request is the method's key after the feed path.
+func TestKeyMatchesMethod(t *testing.T) {
+  methods := []api.ApiMethod{
+    api.MethodRouteConfig("sf-muni", "N"),
+    api.MethodPredictionsForMultiStops("sf-muni",
+      api.RouteStop{Route: "N", Stop: "5240"},
+      api.RouteStop{Route: "J", Stop: "4006"},
+    ),
+  }
+
+  for _, m := range methods {
+    req, err := http.NewRequest(http.MethodGet, "http://feed.invalid/service/publicJSONFeed"+m.Query(), nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if got, want := replay.Key(req), "publicJSONFeed?"+m.Key(); got != want {
+      t.Errorf("got key %s, want %s", got, want)
+    }
+  }
+}